@@ -4,7 +4,9 @@ import (
 	"socks5/client"
 	"flag"
 	"log"
+	"net"
 	"socks5"
+	"strings"
 )
 
 func main() {
@@ -14,6 +16,9 @@ func main() {
 		srvAddr string
 		un string
 		pwd string
+		useTls bool
+		pins string
+		tlsOpts = new(client.TlsOptions)
 		err error
 	)
 	
@@ -23,6 +28,12 @@ func main() {
 	flag.StringVar(&srvAddr, "sa", "", "server address")
 	flag.StringVar(&un, "un", "", "username")
 	flag.StringVar(&pwd, "pwd", "", "password")
+	flag.BoolVar(&useTls, "tls", false, "connect to server over TLS")
+	flag.StringVar(&tlsOpts.ServerName, "sn", "", "server name to verify, the host of server address by default")
+	flag.StringVar(&tlsOpts.CaFile, "ca", "", "CA file to verify server, system roots by default")
+	flag.StringVar(&pins, "pin", "", "comma separated base64 SHA-256 hashes of server SubjectPublicKeyInfo")
+	flag.StringVar(&tlsOpts.CertFile, "cert", "", "client certificate file")
+	flag.StringVar(&tlsOpts.KeyFile, "key", "", "client key file")
 
 	flag.Parse()
 	
@@ -35,6 +46,20 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if useTls {
+		if tlsOpts.ServerName == "" {
+			tlsOpts.ServerName, _, _ = net.SplitHostPort(srvAddr)
+		}
+
+		if pins != "" {
+			tlsOpts.Pins = strings.Split(pins, ",")
+		}
+
+		if err = clt.SetTls(tlsOpts); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	clt.Un = []byte(un)
 	clt.Pwd = []byte(pwd)
 
@@ -3,7 +3,10 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
 	"socks5/server"
+	"syscall"
 	"time"
 	"socks5"
 )
@@ -26,10 +29,22 @@ func main() {
 	}
 
 	srv = &server.Server{
-		cfg,
-		time.Now(),
+		Cfg:       cfg,
+		StartTime: time.Now(),
 	}
 
+	// the traffic is saved on shutdown so the usage since the last save isn't lost
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		if err := srv.SaveTraffic(); err != nil {
+			log.Println(err)
+		}
+
+		os.Exit(0)
+	}()
+
 	log.Println("Cola is running")
 
 	if err = srv.ListenAndServe(); err != nil {
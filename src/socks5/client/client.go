@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"net"
 	"errors"
 	"log"
@@ -27,6 +28,8 @@ type Client struct {
 	Conn *net.TCPConn
 	Un  []byte
 	Pwd []byte
+	// Tls is used to connect to the server if it's not nil, see SetTls
+	Tls *tls.Config
 }
 
 func (c *Client) SetAddr(addr string) error {
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"net"
 	"bufio"
 	"errors"
@@ -38,7 +39,7 @@ type Conn struct {
 	Client *Client
 	Conn net.Conn
 	ConnBr *bufio.Reader
-	SrvConn *net.TCPConn
+	SrvConn net.Conn
 	SrvBr *bufio.Reader
 }
 
@@ -101,14 +102,25 @@ func (c *Conn) dialServer() error {
 	var (
 		err error
 		t time.Time
+		nc net.Conn
 	)
 
-	if c.SrvConn, err = net.DialTCP("tcp", nil, c.Client.SrvAddr); err != nil {
+	t = time.Now().Add(time.Minute*2)
+
+	// the handshake is done while dialing so the server is verified before
+	// the credentials are sent
+	if c.Client.Tls != nil {
+		nc, err = tls.DialWithDialer(&net.Dialer{Deadline: t}, "tcp", c.Client.SrvAddr.String(), c.Client.Tls)
+	} else {
+		nc, err = net.DialTCP("tcp", nil, c.Client.SrvAddr)
+	}
+
+	if err != nil {
 		c.Client.Log(err)
 		return ErrDialSrvFailed
 	}
 
-	t = time.Now().Add(time.Minute*2)
+	c.SrvConn = nc
 	c.SrvConn.SetDeadline(t)
 
 	c.SrvBr = bufio.NewReader(c.SrvConn)
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"socks6"
+	"sync"
+)
+
+var (
+	ErrSocks6DialSrv        = errors.New("Socks6: failed to dial to server.")
+	ErrSocks6WriteRequest   = errors.New("Socks6: failed to write request.")
+	ErrSocks6AuthFailed     = errors.New("Socks6: authentication failed.")
+	ErrSocks6SessionInvalid = errors.New("Socks6: session is invalid.")
+	ErrSocks6TokenRejected  = errors.New("Socks6: idempotence token was rejected.")
+	ErrSocks6OpFailed       = errors.New("Socks6: operation failed.")
+)
+
+// Socks6Dialer dials to destinations through a SOCKS6 server in a single round trip
+//
+// if RequestSession is true, the first successful request establishes a session
+// and the following requests are authenticated by the session instead of Un and Pwd.
+// if TokenWindow is greater than 0, the requests in a session spend idempotence tokens
+type Socks6Dialer struct {
+	SrvAddr        string
+	Un             []byte
+	Pwd            []byte
+	FastOpen       bool
+	RequestSession bool
+	TokenWindow    uint32
+
+	mu        sync.Mutex
+	sessionId []byte
+	tokenNext uint32
+	tokenEnd  uint32
+}
+
+// Socks6Conn is the connection to the destination, Rep is the operation replay
+type Socks6Conn struct {
+	net.Conn
+	br  *bufio.Reader
+	Rep *socks6.OpReply
+}
+
+func (c *Socks6Conn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
+// Dial connects to addr through the server, initData is sent along with the request
+// and it's carried by the SYN towards addr if FastOpen is true
+func (d *Socks6Dialer) Dial(addr string, initData []byte) (*Socks6Conn, error) {
+	return d.request(socks6.CmdConnect, addr, initData, false)
+}
+
+// Noop sends a NOOP request, it's used to establish a session
+func (d *Socks6Dialer) Noop() error {
+	c, err := d.request(socks6.CmdNoop, "0.0.0.0:0", nil, false)
+	if err != nil {
+		return err
+	}
+
+	return c.Close()
+}
+
+// Teardown ends the session established before
+func (d *Socks6Dialer) Teardown() error {
+	c, err := d.request(socks6.CmdNoop, "0.0.0.0:0", nil, true)
+
+	d.mu.Lock()
+	d.sessionId = nil
+	d.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return c.Close()
+}
+
+// SessionId returns the id of the current session, nil if there isn't one
+func (d *Socks6Dialer) SessionId() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.sessionId
+}
+
+func (d *Socks6Dialer) request(cmd byte, addr string, initData []byte, teardown bool) (*Socks6Conn, error) {
+	var (
+		req  = &socks6.Request{Cmd: cmd}
+		b    []byte
+		nc   net.Conn
+		br   *bufio.Reader
+		auth *socks6.AuthReply
+		op   *socks6.OpReply
+		err  error
+	)
+
+	if req.Addr, err = socks6.NewAddr(addr); err != nil {
+		return nil, err
+	}
+
+	req.Options = d.requestOptions(initData, teardown)
+	if b, err = req.Bytes(); err != nil {
+		return nil, err
+	}
+
+	if nc, err = net.Dial("tcp", d.SrvAddr); err != nil {
+		return nil, ErrSocks6DialSrv
+	}
+
+	if _, err = nc.Write(append(b, initData...)); err != nil {
+		nc.Close()
+		return nil, ErrSocks6WriteRequest
+	}
+
+	br = bufio.NewReader(nc)
+	if auth, err = socks6.ReadAuthReply(br); err == nil {
+		err = d.handleAuthReply(auth)
+	}
+
+	if err == nil {
+		if op, err = socks6.ReadOpReply(br); err == nil && op.Code != socks6.RepSucceeded {
+			err = ErrSocks6OpFailed
+		}
+	}
+
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return &Socks6Conn{nc, br, op}, nil
+}
+
+func (d *Socks6Dialer) requestOptions(initData []byte, teardown bool) socks6.Options {
+	var (
+		opts    socks6.Options
+		methods []byte
+	)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.sessionId != nil {
+		opts = append(opts, socks6.SessionIdOption(d.sessionId))
+		if teardown {
+			opts = append(opts, socks6.Option{Kind: socks6.OptSessionTeardown})
+		}
+
+		if d.tokenNext < d.tokenEnd {
+			opts = append(opts, socks6.IdempotenceExpenditureOption(d.tokenNext))
+			d.tokenNext++
+		} else if d.TokenWindow > 0 {
+			opts = append(opts, socks6.TokenRequestOption(d.TokenWindow))
+		}
+	} else {
+		if len(d.Un) > 0 {
+			methods = append(methods, socks6.MethodUnPwd)
+			opts = append(opts, socks6.AuthDataOption(socks6.MethodUnPwd, socks6.UnPwdAuthData(d.Un, d.Pwd)))
+		}
+
+		if d.RequestSession {
+			opts = append(opts, socks6.Option{Kind: socks6.OptSessionRequest})
+		}
+	}
+
+	opts = append(opts, socks6.AuthMethodAdvertOption(uint16(len(initData)), methods...))
+	if d.FastOpen {
+		opts = append(opts, socks6.TfoOption(uint16(len(initData))))
+	}
+
+	return opts
+}
+
+func (d *Socks6Dialer) handleAuthReply(rep *socks6.AuthReply) error {
+	var (
+		o  socks6.Option
+		ok bool
+	)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if rep.Options.Has(socks6.OptSessionInvalid) {
+		d.sessionId = nil
+		return ErrSocks6SessionInvalid
+	}
+
+	if rep.Type != socks6.AuthSucceeded {
+		return ErrSocks6AuthFailed
+	}
+
+	if rep.Options.Has(socks6.OptIdempotenceRejected) {
+		return ErrSocks6TokenRejected
+	}
+
+	if o, ok = rep.Options.Get(socks6.OptSessionId); ok {
+		d.sessionId = o.Data
+	}
+
+	if o, ok = rep.Options.Get(socks6.OptIdempotenceWindow); ok {
+		base, err1 := o.Uint32(0)
+		size, err2 := o.Uint32(1)
+		if err1 == nil && err2 == nil {
+			d.tokenNext, d.tokenEnd = base, base+size
+		}
+	}
+
+	return nil
+}
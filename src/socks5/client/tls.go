@@ -0,0 +1,100 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+)
+
+var (
+	ErrTlsNoServerName = errors.New("Client: ServerName is required to verify the server.")
+	ErrTlsLoadCa       = errors.New("Client: failed to load the CA file.")
+	ErrTlsLoadCert     = errors.New("Client: failed to load the client certificate or key.")
+	ErrTlsInvalidPin   = errors.New("Client: pin should be the base64 of a SHA-256 hash.")
+	ErrTlsPinMismatch  = errors.New("Client: no certificate of the server matches the pins.")
+)
+
+// TlsOptions are the options of the TLS connection to the server
+//
+// the server certificate is verified against ServerName by CaFile, or the system
+// roots if CaFile is empty. if Pins are given, one certificate of the verified
+// chain should have a SubjectPublicKeyInfo whose SHA-256 is one of the base64 Pins.
+// CertFile and KeyFile are the optional client certificate
+type TlsOptions struct {
+	ServerName string
+	CaFile     string
+	Pins       []string
+	CertFile   string
+	KeyFile    string
+}
+
+// SetTls makes the connections to the server use TLS
+func (c *Client) SetTls(opts *TlsOptions) error {
+	var (
+		tc   = &tls.Config{ServerName: opts.ServerName, MinVersion: tls.VersionTLS12}
+		fc   []byte
+		cert tls.Certificate
+		pins [][]byte
+		err  error
+	)
+
+	if opts.ServerName == "" {
+		return ErrTlsNoServerName
+	}
+
+	if opts.CaFile != "" {
+		if fc, err = ioutil.ReadFile(opts.CaFile); err != nil {
+			return ErrTlsLoadCa
+		}
+
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(fc) {
+			return ErrTlsLoadCa
+		}
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if cert, err = tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile); err != nil {
+			return ErrTlsLoadCert
+		}
+
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	for _, pin := range opts.Pins {
+		b, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(b) != sha256.Size {
+			return ErrTlsInvalidPin
+		}
+
+		pins = append(pins, b)
+	}
+
+	if len(pins) > 0 {
+		tc.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			return verifyPins(pins, chains)
+		}
+	}
+
+	c.Tls = tc
+	return nil
+}
+
+// verifyPins runs after the normal verification, so the chains are the verified ones
+func verifyPins(pins [][]byte, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if string(sum[:]) == string(pin) {
+					return nil
+				}
+			}
+		}
+	}
+
+	return ErrTlsPinMismatch
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listenTls serves a self-signed certificate of cn, the certificate is written to
+// dir so it can be used as the CA file
+func listenTls(t *testing.T, dir string, cn string) (net.Listener, string, *x509.Certificate) {
+	var (
+		key    *ecdsa.PrivateKey
+		der    []byte
+		cert   *x509.Certificate
+		caFile = filepath.Join(dir, "ca.pem")
+		l      net.Listener
+		err    error
+	)
+
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	if der, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	if l, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+
+	return l, caFile, cert
+}
+
+func TestSetTls(t *testing.T) {
+	var (
+		dir   string
+		l     net.Listener
+		ca    string
+		cert  *x509.Certificate
+		tc    *tls.Conn
+		sum   [sha256.Size]byte
+		wrong = sha256.Sum256([]byte("cola"))
+		err   error
+	)
+
+	if dir, err = ioutil.TempDir("", "cola"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	l, ca, cert = listenTls(t, dir, "cola.test")
+	defer l.Close()
+
+	sum = sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	cases := []struct {
+		opts     *TlsOptions
+		setErr   error
+		dialFail bool
+		dialErr  error
+	}{
+		{&TlsOptions{}, ErrTlsNoServerName, false, nil},
+		{&TlsOptions{ServerName: "cola.test", CaFile: filepath.Join(dir, "none.pem")}, ErrTlsLoadCa, false, nil},
+		{&TlsOptions{ServerName: "cola.test", CaFile: ca, Pins: []string{"cola"}}, ErrTlsInvalidPin, false, nil},
+		{&TlsOptions{ServerName: "cola.test", CaFile: ca}, nil, false, nil},
+		{&TlsOptions{ServerName: "other.test", CaFile: ca}, nil, true, nil},
+		{&TlsOptions{ServerName: "cola.test"}, nil, true, nil},
+		{&TlsOptions{ServerName: "cola.test", CaFile: ca, Pins: []string{base64.StdEncoding.EncodeToString(sum[:])}}, nil, false, nil},
+		{&TlsOptions{ServerName: "cola.test", CaFile: ca, Pins: []string{base64.StdEncoding.EncodeToString(wrong[:])}}, nil, true, ErrTlsPinMismatch},
+	}
+
+	for i, cs := range cases {
+		c := &Client{}
+		if err = c.SetTls(cs.opts); err != cs.setErr {
+			t.Fatal("Unexpected error of SetTls", i, err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if tc, err = tls.Dial("tcp", l.Addr().String(), c.Tls); err == nil {
+			tc.Close()
+		}
+
+		if (err != nil) != cs.dialFail || (cs.dialErr != nil && err != cs.dialErr) {
+			t.Fatal("Unexpected result of the handshake", i, err)
+		}
+	}
+}
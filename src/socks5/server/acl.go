@@ -0,0 +1,265 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	aclActionAllow = "allow"
+	aclActionDeny  = "deny"
+)
+
+var (
+	ErrAclDenied        = errors.New("Acl: destination is not allowed by ruleset.")
+	ErrAclInvalidAction = errors.New("Acl: Action should be \"allow\" or \"deny\".")
+	ErrAclInvalidCidr   = errors.New("Acl: invalid CIDR.")
+	ErrAclInvalidDomain = errors.New("Acl: invalid domain pattern.")
+	ErrAclInvalidPorts  = errors.New("Acl: invalid port range.")
+)
+
+// AclRule matches a destination if all of its non-empty fields match, Domains
+// are globs like "*.example.com" or suffixes like ".example.com" which match
+// example.com and all its subdomains, Ports are like "443" or "8000-9000"
+type AclRule struct {
+	Action  string   `json:"Action"`
+	Cidrs   []string `json:"Cidrs"`
+	Domains []string `json:"Domains"`
+	Ports   []string `json:"Ports"`
+
+	nets  []*net.IPNet
+	ports [][2]int
+}
+
+func (r *AclRule) compile() error {
+	var (
+		n   *net.IPNet
+		lo  int
+		hi  int
+		err error
+	)
+
+	switch r.Action {
+	case aclActionAllow, aclActionDeny:
+	default:
+		return ErrAclInvalidAction
+	}
+
+	r.nets = nil
+	for _, cidr := range r.Cidrs {
+		if _, n, err = net.ParseCIDR(cidr); err != nil {
+			return ErrAclInvalidCidr
+		}
+
+		r.nets = append(r.nets, n)
+	}
+
+	for _, d := range r.Domains {
+		if _, err = path.Match(d, ""); err != nil || d == "" {
+			return ErrAclInvalidDomain
+		}
+	}
+
+	r.ports = nil
+	for _, p := range r.Ports {
+		if lo, hi, err = parsePortRange(p); err != nil {
+			return err
+		}
+
+		r.ports = append(r.ports, [2]int{lo, hi})
+	}
+
+	return nil
+}
+
+// match reports whether the rule matches the destination, domain is "" if
+// the client asked for an IP address
+func (r *AclRule) match(domain string, ip net.IP, port int) bool {
+	return r.matchIp(ip) && r.matchHost(domain, port)
+}
+
+func (r *AclRule) matchIp(ip net.IP) bool {
+	if len(r.nets) == 0 {
+		return true
+	}
+
+	for _, n := range r.nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchHost matches the fields of the rule other than Cidrs
+func (r *AclRule) matchHost(domain string, port int) bool {
+	var (
+		ok bool
+	)
+
+	if len(r.Domains) > 0 {
+		if ok = false; domain != "" {
+			for _, d := range r.Domains {
+				if matchDomain(d, domain) {
+					ok = true
+					break
+				}
+			}
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	if len(r.ports) > 0 {
+		ok = false
+		for _, pr := range r.ports {
+			if port >= pr[0] && port <= pr[1] {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchDomain matches domain against a glob or a suffix which starts with "."
+func matchDomain(pattern string, domain string) bool {
+	pattern = strings.ToLower(pattern)
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if strings.HasPrefix(pattern, ".") {
+		return domain == pattern[1:] || strings.HasSuffix(domain, pattern)
+	}
+
+	ok, _ := path.Match(pattern, domain)
+	return ok
+}
+
+func parsePortRange(s string) (int, int, error) {
+	var (
+		lo  int
+		hi  int
+		err error
+		i   = strings.IndexByte(s, '-')
+	)
+
+	if i < 0 {
+		if lo, err = strconv.Atoi(s); err != nil || lo < 0 || lo > 0xFFFF {
+			return 0, 0, ErrAclInvalidPorts
+		}
+
+		return lo, lo, nil
+	}
+
+	if lo, err = strconv.Atoi(s[:i]); err != nil {
+		return 0, 0, ErrAclInvalidPorts
+	}
+
+	if hi, err = strconv.Atoi(s[i+1:]); err != nil || lo < 0 || lo > hi || hi > 0xFFFF {
+		return 0, 0, ErrAclInvalidPorts
+	}
+
+	return lo, hi, nil
+}
+
+// compileAcl compiles the rules of all users
+func (c *Config) compileAcl() error {
+	for _, r := range c.AclRules {
+		if err := r.compile(); err != nil {
+			return err
+		}
+	}
+
+	for _, rules := range c.UserAclRules {
+		for _, r := range rules {
+			if err := r.compile(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// allowDst evaluates the rules of the user and then the global ones in order,
+// the first matched rule decides, AclDefault decides if none of them matches
+func (c *Config) allowDst(user string, host string, ip net.IP, port int) bool {
+	var (
+		domain string
+	)
+
+	// fail closed if the rules are broken
+	if c.compile() != nil {
+		return false
+	}
+
+	if net.ParseIP(host) == nil {
+		domain = host
+	}
+
+	for _, rules := range [][]*AclRule{c.UserAclRules[user], c.AclRules} {
+		for _, r := range rules {
+			if r.match(domain, ip, port) {
+				return r.Action == aclActionAllow
+			}
+		}
+	}
+
+	return c.AclDefault != aclActionDeny
+}
+
+// aclNeedsIp reports whether the IP of the domain decides, it's true if a rule
+// with Cidrs is reached before any rule without Cidrs matches
+func (c *Config) aclNeedsIp(user string, domain string, port int) bool {
+	if c.compile() != nil {
+		return false
+	}
+
+	for _, rules := range [][]*AclRule{c.UserAclRules[user], c.AclRules} {
+		for _, r := range rules {
+			if r.matchHost(domain, port) {
+				return len(r.nets) > 0
+			}
+		}
+	}
+
+	return false
+}
+
+// checkAcl checks c.dstHost and c.dstAddr against the rules of the identity, the
+// domain is resolved only if the Cidrs of the rules decide and it's denied if it
+// can't be resolved then
+func (c *conn) checkAcl() error {
+	var (
+		host string
+		err  error
+	)
+
+	if host, _, err = net.SplitHostPort(c.dstHost); err != nil {
+		host = c.dstHost
+	}
+
+	if c.dstAddr.IP == nil && c.server.Cfg.aclNeedsIp(c.userName(), host, c.dstAddr.Port) {
+		if err = c.resolveDst(); err != nil {
+			c.server.Log(err, c.dstHost)
+			return ErrAclDenied
+		}
+	}
+
+	if !c.server.Cfg.allowDst(c.userName(), host, c.dstAddr.IP, c.dstAddr.Port) {
+		return ErrAclDenied
+	}
+
+	return nil
+}
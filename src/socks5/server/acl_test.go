@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllowDst(t *testing.T) {
+	var (
+		cfg = &Config{
+			AclRules: []*AclRule{
+				{Action: "deny", Cidrs: []string{"10.0.0.0/8"}},
+				{Action: "deny", Domains: []string{".internal.example.com"}},
+				{Action: "allow", Domains: []string{"*.example.com"}, Ports: []string{"80", "443"}},
+				{Action: "deny", Domains: []string{"*.example.com"}},
+			},
+			UserAclRules: map[string][]*AclRule{
+				"Usr1": {{Action: "allow", Cidrs: []string{"10.1.0.0/16"}, Ports: []string{"8000-9000"}}},
+			},
+		}
+		cases = []struct {
+			user string
+			host string
+			ip   string
+			port int
+			ok   bool
+		}{
+			{"", "10.1.2.3", "10.1.2.3", 8080, false},
+			{"Usr1", "10.1.2.3", "10.1.2.3", 8080, true},
+			{"Usr1", "10.1.2.3", "10.1.2.3", 22, false},
+			{"", "internal.example.com", "192.0.2.1", 443, false},
+			{"", "a.internal.example.com", "192.0.2.1", 443, false},
+			{"", "www.example.com", "192.0.2.1", 443, true},
+			{"", "www.example.com", "192.0.2.1", 22, false},
+			{"", "192.0.2.1", "192.0.2.1", 22, true},
+		}
+	)
+
+	if err := cfg.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		if cfg.allowDst(c.user, c.host, net.ParseIP(c.ip), c.port) != c.ok {
+			t.Fatal("Unexpected result of", c)
+		}
+	}
+
+	cfg.AclDefault = "deny"
+	if cfg.allowDst("", "192.0.2.1", net.ParseIP("192.0.2.1"), 22) {
+		t.Fatal("AclDefault should deny")
+	}
+
+	cfg = &Config{AclRules: []*AclRule{{Action: "deny", Ports: []string{"9-1"}}}}
+	if cfg.check() != ErrAclInvalidPorts {
+		t.Fatal("Expected invalid ports")
+	}
+}
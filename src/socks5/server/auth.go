@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net"
+)
+
+// Identity is who the client was authenticated as, it's attached to the
+// connection for the policies applied after authentication
+type Identity struct {
+	Name string
+}
+
+// Authenticator checks the credentials sent by the client at addr, the
+// returned error is logged and the client is rejected if it's not nil
+type Authenticator interface {
+	Authenticate(un string, pwd string, addr net.Addr) (*Identity, error)
+}
+
+// UsrPwdPairs is the Authenticator which checks the passwords in a map, the
+// passwords are either plaintext or bcrypt, argon2id and SHA-crypt hashes
+type UsrPwdPairs map[string]string
+
+func (ps UsrPwdPairs) Authenticate(un string, pwd string, addr net.Addr) (*Identity, error) {
+	up, ok := ps[un]
+	if !ok {
+		// the timing shouldn't tell whether the user exists
+		verifyPwd(pwdDummyHash, pwd)
+		return nil, ErrAuthUnPwdInvalidUnOrPwd
+	}
+
+	if verifyPwd(up, pwd) {
+		return &Identity{Name: un}, nil
+	}
+
+	return nil, ErrAuthUnPwdInvalidUnOrPwd
+}
+
+// authenticate checks the credentials by the Authenticator of the server and
+// attaches the identity to the connection
+func (c *conn) authenticate(un string, pwd string) error {
+	var (
+		err error
+	)
+
+	if c.identity, err = c.server.authenticator().Authenticate(un, pwd, c.netConn.RemoteAddr()); err != nil {
+		c.identity = nil
+		return err
+	}
+
+	return nil
+}
+
+// userName returns the name of the identity, "" for anonymous clients
+func (c *conn) userName() string {
+	if c.identity == nil {
+		return ""
+	}
+
+	return c.identity.Name
+}
+
+// authMethods returns the allowed auth methods of the client, method 0 is
+// allowed for the clients with an identity mapped from their certificate or address
+func (c *conn) authMethods() []uint8 {
+	var (
+		methods = c.server.Cfg.authMethods()
+	)
+
+	if c.bareIdentity == nil || c.server.Cfg.allowBare() {
+		return methods
+	}
+
+	return append(append([]uint8{}, methods...), authMethodBare)
+}
+
+func (c *conn) allowAuthMethod(method uint8) bool {
+	for _, m := range c.authMethods() {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptBare attaches the identity mapped from the client certificate or address if method 0
+// is allowed for the client
+func (c *conn) acceptBare() bool {
+	if !c.allowAuthMethod(authMethodBare) {
+		return false
+	}
+
+	c.method = authMethodBare
+	c.identity = c.bareIdentity
+	return true
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAuth accepts any user whose password is "team" as the identity "team"
+type testAuth struct {
+	mu   sync.Mutex
+	addr net.Addr
+}
+
+func (a *testAuth) Authenticate(un string, pwd string, addr net.Addr) (*Identity, error) {
+	a.mu.Lock()
+	a.addr = addr
+	a.mu.Unlock()
+
+	if pwd != "team" {
+		return nil, errors.New("Test: wrong password.")
+	}
+
+	return &Identity{Name: "team"}, nil
+}
+
+func TestCustomAuth(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		port = echo.Addr().(*net.TCPAddr).Port
+		auth = &testAuth{}
+		cfg  = &Config{
+			AuthMethods:  []uint8{authMethodUnPwd},
+			AclDefault:   aclActionDeny,
+			UserAclRules: map[string][]*AclRule{"team": {{Action: aclActionAllow, Cidrs: []string{"127.0.0.0/8"}}}},
+		}
+		l   net.Listener
+		err error
+	)
+
+	defer echo.Close()
+
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	cfg.DstGuardAllow = []string{"127.0.0.0/8"}
+	go (&Server{Cfg: cfg, Auth: auth, StartTime: time.Now()}).Serve(l)
+
+	for pwd, status := range map[string]byte{"team": 0, "other": 1} {
+		var (
+			nc  net.Conn
+			buf = make([]byte, 10)
+		)
+
+		if nc, err = net.Dial("tcp", l.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+
+		nc.Write([]byte{version5, 1, authMethodUnPwd})
+		if _, err = io.ReadFull(nc, buf[:2]); err != nil || buf[1] != authMethodUnPwd {
+			t.Fatal("Expected method 2 to be selected", buf[:2], err)
+		}
+
+		nc.Write(append(append([]byte{1, 3}, "bob"...), append([]byte{byte(len(pwd))}, pwd...)...))
+		if _, err = io.ReadFull(nc, buf[:2]); err != nil || buf[1] != status {
+			t.Fatal("Unexpected status of", pwd, buf[:2], err)
+		}
+
+		auth.mu.Lock()
+		if auth.addr.String() != nc.LocalAddr().String() {
+			t.Fatal("Expected the address of the client", auth.addr)
+		}
+		auth.mu.Unlock()
+
+		if status == 0 {
+			// the ACL of the identity allows the destination
+			nc.Write([]byte{version5, cmdConnect, reqRsv, aTypIpv4, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+			if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != repSucceeded {
+				t.Fatal("Expected the identity to be attached", buf, err)
+			}
+		}
+
+		nc.Close()
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ErrBindListen         = errors.New("Bind: failed to listen.")
+	ErrBindAccept         = errors.New("Bind: failed to accept the incoming connection.")
+	ErrBindUnexpectedHost = errors.New("Bind: incoming connection is from an unexpected host.")
+)
+
+// bind serves the BIND command of both SOCKS5 and SOCKS4, see https://tools.ietf.org/html/rfc1928#section-4
+//
+// the first replay carries the address of the listener and the second one
+// carries the address of the incoming host, only one connection is accepted
+func (c *conn) bind() error {
+	var (
+		l     *net.TCPListener
+		err   error
+		rAddr *net.TCPAddr
+	)
+
+	if err = c.resolveDst(); err != nil {
+		c.server.Log(err, c.dstHost)
+		return c.writeBindReplay(repHostUnReachable, nil)
+	}
+
+	if err = c.checkAcl(); err != nil {
+		c.server.Log(err)
+		return c.writeBindReplay(repNotAllowed, nil)
+	}
+
+	if err = c.checkBindRoute(c.dstAddr); err != nil {
+		c.server.Log(err)
+		return c.writeBindReplay(repNotAllowed, nil)
+	}
+
+	if err = c.checkQuota(false); err != nil {
+		return c.writeBindReplay(repNotAllowed, nil)
+	}
+
+	if l, err = c.listenBind(); err != nil {
+		c.server.Log(err)
+		return c.writeBindReplay(repGeneralServerFailure, nil)
+	}
+
+	defer l.Close()
+
+	if err = c.writeBindReplay(repSucceeded, c.bindReplayAddr(l)); err != nil {
+		return err
+	}
+
+	l.SetDeadline(time.Now().Add(c.server.Cfg.bindTimeout()))
+	if c.dstConn, err = l.AcceptTCP(); err != nil {
+		c.dstConn = nil
+		c.server.Log(ErrBindAccept)
+		return c.writeBindReplay(repGeneralServerFailure, nil)
+	}
+
+	l.Close()
+
+	rAddr = c.dstConn.RemoteAddr().(*net.TCPAddr)
+	if !c.isExpectedBindHost(rAddr) {
+		c.dstConn.Close()
+		c.dstConn = nil
+		c.server.Log(ErrBindUnexpectedHost, rAddr)
+		return c.writeBindReplay(repGeneralServerFailure, nil)
+	}
+
+	// the peer may be any host if DST.ADDR is unspecified
+	if err = c.checkBindRoute(rAddr); err != nil {
+		c.dstConn.Close()
+		c.dstConn = nil
+		c.server.Log(err, rAddr)
+		return c.writeBindReplay(repNotAllowed, nil)
+	}
+
+	if err = c.writeBindReplay(repSucceeded, rAddr); err != nil {
+		return err
+	}
+
+	return c.relay()
+}
+
+// checkBindRoute checks the peer of BIND by the route rules, the domain of DST.ADDR
+// is checked too if addr is DST.ADDR
+func (c *conn) checkBindRoute(addr *net.TCPAddr) error {
+	var (
+		host = addr.IP.String()
+	)
+
+	if addr == c.dstAddr {
+		if h, _, err := net.SplitHostPort(c.dstHost); err == nil {
+			host = h
+		}
+	}
+
+	return c.server.Cfg.checkLocalRoute(c.userName(), host, addr.IP, addr.Port)
+}
+
+func (c *conn) listenBind() (*net.TCPListener, error) {
+	var (
+		cfg  = c.server.Cfg
+		l    *net.TCPListener
+		err  error
+		addr = &net.TCPAddr{}
+		port uint16
+	)
+
+	if cfg.BindAddr != "" {
+		addr.IP = net.ParseIP(cfg.BindAddr)
+	} else if lAddr, ok := c.netConn.LocalAddr().(*net.TCPAddr); ok {
+		addr.IP = lAddr.IP
+	}
+
+	if len(cfg.BindPortRange) == 0 {
+		if l, err = net.ListenTCP("tcp", addr); err != nil {
+			return nil, ErrBindListen
+		}
+
+		return l, nil
+	}
+
+	for port = cfg.BindPortRange[0]; ; port++ {
+		addr.Port = int(port)
+		if l, err = net.ListenTCP("tcp", addr); err == nil {
+			return l, nil
+		}
+
+		if port == cfg.BindPortRange[1] {
+			break
+		}
+	}
+
+	return nil, ErrBindListen
+}
+
+// bindReplayAddr returns the address which the client should tell the application
+// server to connect to, an unspecified listening address is replaced by the one
+// the client used to reach us
+func (c *conn) bindReplayAddr(l *net.TCPListener) *net.TCPAddr {
+	var (
+		addr  = l.Addr().(*net.TCPAddr)
+		lAddr *net.TCPAddr
+		ok    bool
+	)
+
+	if !addr.IP.IsUnspecified() {
+		return addr
+	}
+
+	if lAddr, ok = c.netConn.LocalAddr().(*net.TCPAddr); !ok {
+		return addr
+	}
+
+	return &net.TCPAddr{IP: lAddr.IP, Port: addr.Port}
+}
+
+// isExpectedBindHost reports whether the incoming connection comes from one of the
+// addresses of DST.ADDR, any host is allowed if DST.ADDR is unspecified
+func (c *conn) isExpectedBindHost(rAddr *net.TCPAddr) bool {
+	if c.dstAddr == nil || c.dstAddr.IP == nil || c.dstAddr.IP.IsUnspecified() {
+		return true
+	}
+
+	return hasIP(c.dstIPs, rAddr.IP)
+}
+
+// writeBindReplay writes the replay in the protocol version of the client
+func (c *conn) writeBindReplay(rep byte, addr *net.TCPAddr) error {
+	if c.version == version4 {
+		if rep == repSucceeded {
+			return c.writeReplay4(rep4Granted, addr)
+		}
+
+		return c.writeReplay4(rep4Rejected, addr)
+	}
+
+	return c.writeCmdReplayAddr(rep, addr)
+}
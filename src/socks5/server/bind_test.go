@@ -0,0 +1,158 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// bindRequest negotiates method 0 and sends BIND of dst, the first replay is returned
+func bindRequest(t *testing.T, srv net.Listener, dst net.IP) (net.Conn, []byte) {
+	var (
+		nc  net.Conn
+		buf = make([]byte, 10)
+		err error
+	)
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	nc.Write([]byte{version5, 1, authMethodBare})
+	if _, err = io.ReadFull(nc, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	nc.Write(append(append([]byte{version5, cmdBind, reqRsv, aTypIpv4}, dst.To4()...), 0, 0))
+	if _, err = io.ReadFull(nc, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return nc, buf
+}
+
+func TestBind(t *testing.T) {
+	var (
+		busy net.Listener
+		lo   int
+		srv  net.Listener
+		nc   net.Conn
+		peer net.Conn
+		rep  []byte
+		port int
+		buf  = make([]byte, 10)
+		err  error
+	)
+
+	// the first port of the range is taken so the next one is used
+	if busy, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer busy.Close()
+
+	lo = busy.Addr().(*net.TCPAddr).Port
+	srv = listenServer(t, &Config{BindPortRange: []uint16{uint16(lo), uint16(lo + 16)}})
+	defer srv.Close()
+
+	nc, rep = bindRequest(t, srv, net.IPv4(127, 0, 0, 1))
+	defer nc.Close()
+
+	if port = int(rep[8])<<8 | int(rep[9]); rep[1] != repSucceeded || port <= lo || port > lo+16 {
+		t.Fatal("Unexpected first replay", rep)
+	}
+
+	if peer, err = net.Dial("tcp", (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}).String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer peer.Close()
+
+	if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != repSucceeded {
+		t.Fatal("Unexpected second replay", buf, err)
+	}
+
+	if pPort := peer.LocalAddr().(*net.TCPAddr).Port; int(buf[8])<<8|int(buf[9]) != pPort {
+		t.Fatal("Expected the address of the peer in the second replay", buf, pPort)
+	}
+
+	peer.Write([]byte("ping"))
+	if _, err = io.ReadFull(nc, buf[:4]); err != nil || string(buf[:4]) != "ping" {
+		t.Fatal("Unexpected relayed data", buf[:4], err)
+	}
+}
+
+func TestBindUnexpectedHost(t *testing.T) {
+	var (
+		srv  = listenServer(t, &Config{})
+		nc   net.Conn
+		peer net.Conn
+		rep  []byte
+		buf  = make([]byte, 10)
+		err  error
+	)
+
+	defer srv.Close()
+
+	// the peer comes from 127.0.0.1 instead of 127.0.0.2
+	nc, rep = bindRequest(t, srv, net.IPv4(127, 0, 0, 2))
+	defer nc.Close()
+
+	if rep[1] != repSucceeded {
+		t.Fatal("Unexpected first replay", rep)
+	}
+
+	if peer, err = net.Dial("tcp", (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(rep[8])<<8 | int(rep[9])}).String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer peer.Close()
+
+	if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != repGeneralServerFailure {
+		t.Fatal("Expected the peer to be rejected", buf, err)
+	}
+}
+
+func TestBindDualStackHost(t *testing.T) {
+	var (
+		dns, _ = countingDns(t, map[string][]net.IP{"cola.test": {net.IPv6loopback, net.IPv4(127, 0, 0, 1)}})
+		srv    = listenServer(t, &Config{
+			Resolvers:       map[string]*ResolverConfig{"tcp": {Type: resolverTypeTcp, Servers: []string{dns.Addr().String()}}},
+			DefaultResolver: "tcp",
+		})
+		nc   net.Conn
+		peer net.Conn
+		buf  = make([]byte, 10)
+		err  error
+	)
+
+	defer dns.Close()
+	defer srv.Close()
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	nc.Write([]byte{version5, 1, authMethodBare})
+	if _, err = io.ReadFull(nc, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// the IPv6 address comes first but the peer connects over IPv4
+	nc.Write(append(append([]byte{version5, cmdBind, reqRsv, aTypDomain, 9}, "cola.test"...), 0, 0))
+	if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != repSucceeded {
+		t.Fatal("Unexpected first replay", buf, err)
+	}
+
+	if peer, err = net.Dial("tcp", (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(buf[8])<<8 | int(buf[9])}).String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer peer.Close()
+
+	if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != repSucceeded {
+		t.Fatal("Expected the peer at the IPv4 address of the host to be accepted", buf, err)
+	}
+}
@@ -4,19 +4,174 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"log"
+	"net"
 	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBindTimeout    = time.Minute
+	defaultUdpIdleTimeout = 2 * time.Minute
 )
 
 type Config struct {
-	ServerPort  uint16            `json:ServerPort`
-	AuthMethods []uint8           `json:AuthMethods`
-	UsrPwdPairs map[string]string `json:UsrPwdPairs`
-	UseTls      bool              `json:UseTls`
+	ServerPort uint16 `json:"ServerPort"`
+	// AuthMethods are the allowed auth methods in the order of preference,
+	// [2, 0] is used if it's empty
+	AuthMethods []uint8     `json:"AuthMethods"`
+	UsrPwdPairs UsrPwdPairs `json:"UsrPwdPairs"`
+	UseTls      bool        `json:"UseTls"`
+
+	// TlsCertFile and TlsKeyFile are the PEM files of the listener used if UseTls
+	// is true, they are reloaded once changed. TlsMinVersion is like "1.2" which
+	// is the default, TlsCipherSuites are the names of the TLS 1.0-1.2 suites
+	TlsCertFile     string   `json:"TlsCertFile"`
+	TlsKeyFile      string   `json:"TlsKeyFile"`
+	TlsMinVersion   string   `json:"TlsMinVersion"`
+	TlsCipherSuites []string `json:"TlsCipherSuites"`
+
+	// TlsClientAuth is "" to ignore client certificates, "verify" to verify them
+	// if given or "require" to require them. the certificates are verified by
+	// TlsClientCaFile and the identity is their subject CN, or their first SAN if
+	// TlsClientIdentity is "san". the clients with an identity can use method 0
+	TlsClientAuth     string `json:"TlsClientAuth"`
+	TlsClientCaFile   string `json:"TlsClientCaFile"`
+	TlsClientIdentity string `json:"TlsClientIdentity"`
+
+	// AclRules are the destination rules of all users, UserAclRules are the rules
+	// of each user which are evaluated before AclRules. the first matched rule
+	// decides and AclDefault, "allow" or "deny", decides if none of them matches
+	AclRules     []*AclRule            `json:"AclRules"`
+	UserAclRules map[string][]*AclRule `json:"UserAclRules"`
+	AclDefault   string                `json:"AclDefault"`
+
+	// RateLimit is the bandwidth limit of each user, UserRateLimits overrides it
+	// for some users. a limit is shared by all the sessions of the user, the
+	// anonymous clients are limited by their IPs
+	RateLimit      *RateLimit            `json:"RateLimit"`
+	UserRateLimits map[string]*RateLimit `json:"UserRateLimits"`
+
+	// Quota limits the sessions of each user, UserQuotas overrides it for some users
+	Quota      *Quota            `json:"Quota"`
+	UserQuotas map[string]*Quota `json:"UserQuotas"`
+
+	// TrafficQuota is the daily and monthly bytes of each user, UserTrafficQuotas
+	// overrides it for some users. new sessions are refused once it's used up
+	TrafficQuota      *TrafficQuota            `json:"TrafficQuota"`
+	UserTrafficQuotas map[string]*TrafficQuota `json:"UserTrafficQuotas"`
+	// TrafficFile keeps the traffic of users across restarts, it's saved every
+	// TrafficSaveInterval seconds, 60 by default
+	TrafficFile         string `json:"TrafficFile"`
+	TrafficSaveInterval uint   `json:"TrafficSaveInterval"`
+	// TrafficApiAddr is the address to serve the traffic of users as JSON over HTTP,
+	// it should be a loopback address unless TrafficApiToken is set, which is then
+	// required as "Authorization: Bearer <TrafficApiToken>"
+	TrafficApiAddr  string `json:"TrafficApiAddr"`
+	TrafficApiToken string `json:"TrafficApiToken"`
+
+	// Upstreams are the named chains of upstream proxies, the first hop of a chain
+	// is connected directly and the destinations are connected by the last one.
+	// DefaultUpstream is the chain used for all traffic, "" means to connect directly
+	Upstreams       map[string][]*UpstreamHop `json:"Upstreams"`
+	DefaultUpstream string                    `json:"DefaultUpstream"`
+	// UpstreamPools are the named groups of Upstreams with load balancing and
+	// failover, their names can be used wherever the names of Upstreams are used
+	UpstreamPools map[string]*UpstreamPool `json:"UpstreamPools"`
+	// RouteRules decide how each destination is reached, the first matched rule
+	// decides and DefaultUpstream is used if none of them matches
+	RouteRules []*RouteRule `json:"RouteRules"`
+
+	// Resolvers are the named resolvers of destinations, the one of a destination
+	// is chosen by the Resolver of RouteRules, then UserResolvers which maps users
+	// to resolvers and then DefaultResolver. the system resolver is used if it's ""
+	Resolvers       map[string]*ResolverConfig `json:"Resolvers"`
+	UserResolvers   map[string]string          `json:"UserResolvers"`
+	DefaultResolver string                     `json:"DefaultResolver"`
+	// the answers of all resolvers are cached for their TTLs clamped by DnsCacheMinTtl
+	// and DnsCacheMaxTtl, 3600 by default. NXDOMAIN is cached for the TTL of its SOA
+	// record or DnsCacheNegativeTtl, 30 by default. DnsCacheSize is the max entries,
+	// 4096 by default
+	DisableDnsCache     bool `json:"DisableDnsCache"`
+	DnsCacheSize        uint `json:"DnsCacheSize"`
+	DnsCacheMinTtl      uint `json:"DnsCacheMinTtl"`
+	DnsCacheMaxTtl      uint `json:"DnsCacheMaxTtl"`
+	DnsCacheNegativeTtl uint `json:"DnsCacheNegativeTtl"`
+	// PreferFamily orders the addresses of a domain to connect, "" or "ipv6" tries
+	// IPv6 first, "ipv4" tries IPv4 first, "ipv4only" and "ipv6only" drop the other
+	// family. the next address is tried if the previous one doesn't connect in
+	// ConnectAttemptDelay milliseconds, 250 by default
+	PreferFamily        string `json:"PreferFamily"`
+	ConnectAttemptDelay uint   `json:"ConnectAttemptDelay"`
+	// HostOverrides maps the requested "host" or "host:port" to the target "host"
+	// or "host:port" like a hosts file, the requested port is kept if the target
+	// has none and the entries with ports are preferred. the hosts can be domains
+	// or IPs, the overridden destinations are checked and connected instead
+	HostOverrides map[string]string `json:"HostOverrides"`
+
+	// HtpasswdFile is a file of "username:hash" lines, its users are merged into UsrPwdPairs
+	HtpasswdFile string `json:"HtpasswdFile"`
+
+	// BindAddr is the address to listen on for BIND requests, the local address
+	// of the client connection is used if it's empty
+	BindAddr string `json:"BindAddr"`
+	// BindPortRange is the inclusive [min, max] ports used by BIND listeners,
+	// a random port is used if it's empty
+	BindPortRange []uint16 `json:"BindPortRange"`
+	// BindTimeout is the seconds to wait for the incoming connection of BIND
+	BindTimeout uint `json:"BindTimeout"`
+
+	// UdpIdleTimeout is the seconds an UDP association can be idle before it's closed
+	UdpIdleTimeout uint `json:"UdpIdleTimeout"`
+	// UdpLifetime is the max seconds an UDP association can live, 0 means unlimited
+	UdpLifetime uint `json:"UdpLifetime"`
+
+	// Socks4Auth decides how the USERID of SOCKS4 requests is checked, "" ignores
+	// the USERID and accepts the clients only if method 0 is in AuthMethods, "unpwd"
+	// expects "username:password" in UsrPwdPairs and "ident" expects one of Socks4UserIds
+	Socks4Auth    string   `json:"Socks4Auth"`
+	Socks4UserIds []string `json:"Socks4UserIds"`
+
+	// the guard refuses to connect to special-purpose addresses such as loopback,
+	// private and link-local ones unless they are in DstGuardAllow
+	DisableDstGuard bool     `json:"DisableDstGuard"`
+	DstGuardAllow   []string `json:"DstGuardAllow"`
+
+	// ClientDeny and ClientAllow are checked right after accepting, the clients in
+	// ClientDeny are refused and only the ones in ClientAllow are accepted if it's
+	// not empty. IpIdentities maps CIDRs to identities, the clients from them can
+	// use method 0 and they are treated as the mapped identities
+	ClientAllow  []string          `json:"ClientAllow"`
+	ClientDeny   []string          `json:"ClientDeny"`
+	IpIdentities map[string]string `json:"IpIdentities"`
+
+	compileOnce  sync.Once
+	compileErr   error
+	guardAllow   []*net.IPNet
+	clientAllow  []*net.IPNet
+	clientDeny   []*net.IPNet
+	ipIdentities []*ipIdentity
+	resolvers    map[string]Resolver
+	sysResolver  Resolver
+	dnsCache     *dnsCache
+
+	hostOverrides map[string]string
 }
 
 var (
 	ErrReadCfgFile    = errors.New("Failed to read config file: it doesn't exist or unreadable.")
 	ErrParseCfgString = errors.New("Invalid JSON format of config string.")
+
+	ErrCfgReadHtpasswd         = errors.New("Config: failed to read HtpasswdFile.")
+	ErrCfgInvalidHtpasswd      = errors.New("Config: invalid line in HtpasswdFile.")
+	ErrCfgDuplicateUser        = errors.New("Config: user exists in both UsrPwdPairs and HtpasswdFile.")
+	ErrCfgUnknownAuthMethod    = errors.New("Config: unknown auth method, only 0 and 2 are supported.")
+	ErrCfgInvalidBindAddr      = errors.New("Config: invalid BindAddr.")
+	ErrCfgInvalidBindPortRange = errors.New("Config: BindPortRange should be [min, max] with 0 < min <= max.")
+	ErrCfgInvalidAclDefault    = errors.New("Config: AclDefault should be one of \"\", \"allow\" and \"deny\".")
+	ErrCfgInvalidSocks4Auth    = errors.New("Config: Socks4Auth should be one of \"\", \"unpwd\" and \"ident\".")
 )
 
 func NewConfig(cfgFile string) (c *Config, err error) {
@@ -40,13 +195,211 @@ func NewConfig(cfgFile string) (c *Config, err error) {
 		return nil, ErrParseCfgString
 	}
 
+	if err = c.check(); err != nil {
+		return nil, err
+	}
+
+	if err = c.loadPwds(); err != nil {
+		return nil, err
+	}
+
 	return c, nil
 }
 
+// loadPwds merges the users of HtpasswdFile into UsrPwdPairs and validates the
+// hashes, a warning is logged for each plaintext password
+func (c *Config) loadPwds() error {
+	var (
+		fc  []byte
+		err error
+	)
+
+	if c.HtpasswdFile != "" {
+		if fc, err = ioutil.ReadFile(c.HtpasswdFile); err != nil {
+			return ErrCfgReadHtpasswd
+		}
+
+		if c.UsrPwdPairs == nil {
+			c.UsrPwdPairs = make(UsrPwdPairs)
+		}
+
+		for _, line := range strings.Split(string(fc), "\n") {
+			if line = strings.TrimSpace(line); line == "" || line[0] == '#' {
+				continue
+			}
+
+			i := strings.IndexByte(line, ':')
+			if i <= 0 {
+				return ErrCfgInvalidHtpasswd
+			}
+
+			if _, ok := c.UsrPwdPairs[line[:i]]; ok {
+				return ErrCfgDuplicateUser
+			}
+
+			c.UsrPwdPairs[line[:i]] = line[i+1:]
+		}
+	}
+
+	for un, pwd := range c.UsrPwdPairs {
+		if err = checkPwdHash(pwd); err != nil {
+			log.Println(err, "user:", un)
+			return err
+		}
+
+		if kind, _ := pwdKind(pwd); kind == pwdKindPlain {
+			log.Println("Warning: password of user", un, "is stored in plaintext.")
+		}
+	}
+
+	return nil
+}
+
+// check validates the fields which cannot be verified by unmarshalling
+func (c *Config) check() error {
+	for _, m := range c.AuthMethods {
+		switch m {
+		case authMethodBare, authMethodUnPwd:
+		default:
+			return ErrCfgUnknownAuthMethod
+		}
+	}
+
+	if c.BindAddr != "" && net.ParseIP(c.BindAddr) == nil {
+		return ErrCfgInvalidBindAddr
+	}
+
+	if len(c.BindPortRange) != 0 {
+		if len(c.BindPortRange) != 2 ||
+			c.BindPortRange[0] == 0 ||
+			c.BindPortRange[0] > c.BindPortRange[1] {
+			return ErrCfgInvalidBindPortRange
+		}
+	}
+
+	switch c.AclDefault {
+	case "", aclActionAllow, aclActionDeny:
+	default:
+		return ErrCfgInvalidAclDefault
+	}
+
+	// the rules, resolvers and the DNS cache are compiled once and kept for serving
+	if err := c.compile(); err != nil {
+		return err
+	}
+
+	if err := c.checkDnsCache(); err != nil {
+		return err
+	}
+
+	if err := c.checkTrafficApi(); err != nil {
+		return err
+	}
+
+	if c.RateLimit != nil {
+		if err := c.RateLimit.check(); err != nil {
+			return err
+		}
+	}
+
+	for _, rl := range c.UserRateLimits {
+		if err := rl.check(); err != nil {
+			return err
+		}
+	}
+
+	switch c.Socks4Auth {
+	case socks4AuthNone, socks4AuthUnPwd, socks4AuthIdent:
+	default:
+		return ErrCfgInvalidSocks4Auth
+	}
+
+	if err := c.checkTls(); err != nil {
+		return err
+	}
+
+	if err := c.checkPreferFamily(); err != nil {
+		return err
+	}
+
+	return c.checkUpstreams()
+}
+
 func (c *Config) AuthUnPwd(un string, pwd string) bool {
-	if up, ok := c.UsrPwdPairs[un]; ok {
-		return up == pwd
+	_, err := c.UsrPwdPairs.Authenticate(un, pwd, nil)
+	return err == nil
+}
+
+func (c *Config) authMethods() []uint8 {
+	if len(c.AuthMethods) == 0 {
+		return []uint8{authMethodUnPwd, authMethodBare}
+	}
+
+	return c.AuthMethods
+}
+
+func (c *Config) allowAuthMethod(method uint8) bool {
+	for _, m := range c.authMethods() {
+		if m == method {
+			return true
+		}
 	}
 
 	return false
 }
+
+// allowBare reports whether clients can be accepted without authentication
+func (c *Config) allowBare() bool {
+	return c.allowAuthMethod(authMethodBare)
+}
+
+func (c *Config) bindTimeout() time.Duration {
+	if c.BindTimeout == 0 {
+		return defaultBindTimeout
+	}
+
+	return time.Duration(c.BindTimeout) * time.Second
+}
+
+func (c *Config) udpIdleTimeout() time.Duration {
+	if c.UdpIdleTimeout == 0 {
+		return defaultUdpIdleTimeout
+	}
+
+	return time.Duration(c.UdpIdleTimeout) * time.Second
+}
+
+func (c *Config) udpLifetime() time.Duration {
+	return time.Duration(c.UdpLifetime) * time.Second
+}
+
+// compile compiles the rules, resolvers and the DNS cache, it's done only once and
+// the error is kept. check calls it for the configs of NewConfig and the configs
+// built without NewConfig compile on the first use
+func (c *Config) compile() error {
+	c.compileOnce.Do(func() {
+		if c.compileErr = c.compileAcl(); c.compileErr != nil {
+			return
+		}
+
+		if c.compileErr = c.compileGuard(); c.compileErr != nil {
+			return
+		}
+
+		if c.compileErr = c.compileRoutes(); c.compileErr != nil {
+			return
+		}
+
+		if c.compileErr = c.compileResolvers(); c.compileErr != nil {
+			return
+		}
+
+		if c.compileErr = c.compileHosts(); c.compileErr != nil {
+			return
+		}
+
+		c.compileErr = c.compileSources()
+	})
+
+	return c.compileErr
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"testing"
+	"time"
 )
 
 func TestNewConfig(t *testing.T) {
@@ -17,8 +18,32 @@ func TestNewConfig(t *testing.T) {
 	if cfg.ServerPort != 1080 ||
 		cfg.UsrPwdPairs["Usr1"] != "Pwd1" ||
 		cfg.UsrPwdPairs["Usr2"] != "Pwd2" ||
+		!cfg.AuthUnPwd("Usr3", "Pwd3") ||
 		cfg.AuthMethods[0] != 0 ||
-		cfg.AuthMethods[1] != 2 {
+		cfg.AuthMethods[1] != 2 ||
+		cfg.BindPortRange[0] != 20000 ||
+		cfg.BindPortRange[1] != 20100 ||
+		cfg.bindTimeout() != time.Minute {
 		t.Fatal("Failed to parse")
 	}
 }
+
+func TestConfigAuthMethods(t *testing.T) {
+	var (
+		cfg = &Config{AuthMethods: []uint8{2, 1}}
+	)
+
+	if cfg.check() != ErrCfgUnknownAuthMethod {
+		t.Fatal("Expected unknown auth method")
+	}
+
+	cfg.AuthMethods = []uint8{2}
+	if cfg.check() != nil || cfg.allowBare() {
+		t.Fatal("Method 0 should not be allowed")
+	}
+
+	cfg.AuthMethods = nil
+	if m := cfg.authMethods(); len(m) != 2 || m[0] != 2 || m[1] != 0 {
+		t.Fatal("Invalid default auth methods")
+	}
+}
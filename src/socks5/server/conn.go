@@ -6,12 +6,16 @@ import (
 	"errors"
 	"io"
 	"net"
+	"net/http"
+	"socks6"
 	"strconv"
 	"sync"
+	"syscall"
 )
 
 const (
 	version5 = byte(5)
+	version6 = socks6.Version
 
 	authMethodNone               = byte(0xFF)
 	authMethodBare               = byte(0)
@@ -20,6 +24,8 @@ const (
 	authMethodUnPwdVersion       = byte(1)
 
 	cmdConnect = byte(1)
+	cmdBind    = byte(2)
+	cmdUdp     = byte(3)
 	reqRsv     = byte(0)
 	aTypIpv4   = byte(1)
 	aTypDomain = byte(3)
@@ -27,6 +33,7 @@ const (
 
 	repSucceeded            = byte(0)
 	repGeneralServerFailure = byte(1)
+	repNotAllowed           = byte(2)
 	repNetUnReachable       = byte(3)
 	repHostUnReachable      = byte(4)
 	repConnRefused          = byte(5)
@@ -74,14 +81,31 @@ var (
 )
 
 type conn struct {
-	netConn net.Conn
-	server  *Server
-	br      *bufio.Reader
-	method  byte
-	aTyp    byte
-	dstHost string
-	dstAddr *net.TCPAddr
-	dstConn *net.TCPConn
+	netConn  net.Conn
+	server   *Server
+	br       *bufio.Reader
+	version  byte
+	method   byte
+	identity *Identity
+	cmd      byte
+	aTyp     byte
+	dstHost  string
+	dstAddr  *net.TCPAddr
+	dstIPs   []net.IP
+	dstConn  net.Conn
+	fastOpen bool
+	s6       *socks6Req
+	httpReq  *http.Request
+
+	// bareIdentity is the identity mapped from the client certificate or the
+	// client address, it's attached if method 0 is chosen
+	bareIdentity *Identity
+
+	// quotaUser is the user whose session is held by the conn
+	quotaUser string
+	quotaHeld bool
+
+	trafficWriters []*trafficWriter
 }
 
 func (c *conn) serve() {
@@ -89,6 +113,12 @@ func (c *conn) serve() {
 		err error
 	)
 
+	if err = c.handshakeTls(); err != nil {
+		c.server.Log(err, c.netConn.RemoteAddr())
+		c.close()
+		return
+	}
+
 	if err = c.negotiate(); err != nil {
 		c.server.Log(err)
 		c.close()
@@ -106,10 +136,30 @@ func (c *conn) negotiate() error {
 	var (
 		buf        = make([]byte, 257)
 		err        error
+		ver        []byte
 		methodsNum uint8
 		methods    []byte
 	)
 
+	if ver, err = c.br.Peek(1); err != nil {
+		return ErrNegotiateReadBytes
+	}
+
+	switch c.version = ver[0]; c.version {
+	case version5:
+	case version6:
+		return c.negotiate6()
+	case version4:
+		return c.negotiate4()
+	default:
+		if isHttpMethodByte(c.version) {
+			c.version = versionHttp
+			return c.negotiateHttp()
+		}
+
+		return ErrNegotiateNotSupportedVersion
+	}
+
 	if _, err = c.br.Read(buf); err != nil {
 		return ErrNegotiateReadBytes
 	}
@@ -123,16 +173,23 @@ func (c *conn) negotiate() error {
 	}
 
 	methods = buf[2 : methodsNum+2]
-	if bytes.IndexByte(methods, authMethodUnPwd) != -1 {
-		if err = c.writeNegotiateReplay(authMethodUnPwd); err != nil {
-			return err
+	for _, m := range c.authMethods() {
+		if bytes.IndexByte(methods, m) == -1 {
+			continue
 		}
 
-		return c.subNegotiateAuthUnPwd()
-	}
+		switch m {
+		case authMethodUnPwd:
+			if err = c.writeNegotiateReplay(authMethodUnPwd); err != nil {
+				return err
+			}
 
-	if bytes.IndexByte(methods, authMethodBare) != -1 {
-		return c.writeNegotiateReplay(authMethodBare)
+			return c.subNegotiateAuthUnPwd()
+		case authMethodBare:
+			c.method = authMethodBare
+			c.identity = c.bareIdentity
+			return c.writeNegotiateReplay(authMethodBare)
+		}
 	}
 
 	if err = c.writeNegotiateReplay(authMethodNone); err != nil {
@@ -151,6 +208,7 @@ func (c *conn) subNegotiateAuthUnPwd() error {
 		un   []byte
 		pwd  []byte
 		ok   bool
+		aErr error
 	)
 
 	c.method = authMethodUnPwd
@@ -174,14 +232,15 @@ func (c *conn) subNegotiateAuthUnPwd() error {
 	}
 
 	pwd = buf[3+uLen : 3+uLen+pLen]
-	ok = c.server.Cfg.AuthUnPwd(string(un), string(pwd))
+	aErr = c.authenticate(string(un), string(pwd))
+	ok = aErr == nil
 
 	if err = c.writeAuthUnPwdReplay(ok); err != nil {
 		return err
 	}
 
 	if !ok {
-		return ErrAuthUnPwdInvalidUnOrPwd
+		return aErr
 	}
 
 	return nil
@@ -202,7 +261,10 @@ func (c *conn) parseCommand() error {
 		return ErrParseCmdUnsupportedVersion
 	}
 
-	if buf[1] != cmdConnect {
+	c.cmd = buf[1]
+	switch c.cmd {
+	case cmdConnect, cmdBind, cmdUdp:
+	default:
 		return ErrParseCmdUnsupportedCmd
 	}
 
@@ -217,8 +279,6 @@ func (c *conn) parseCommand() error {
 	default:
 		return ErrParseCmdInvalidATyp
 	}
-
-	return nil
 }
 
 func (c *conn) parseDstAddr() error {
@@ -275,20 +335,70 @@ func (c *conn) parseDstAddr() error {
 	}
 
 	port = uint16(portBytes[0])<<8 + uint16(portBytes[1])
-	c.dstHost = host + ":" + strconv.Itoa(int(port))
-	if c.dstAddr, err = net.ResolveTCPAddr("tcp", c.dstHost); err != nil {
+	c.dstHost = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return c.resolveDstAddr()
+}
+
+// resolveDstAddr parses c.dstHost which is in the form of "host:port", the IP
+// of c.dstAddr is nil for domains which are resolved by prepareExchange
+func (c *conn) resolveDstAddr() error {
+	var (
+		host string
+		ps   string
+		port int
+		err  error
+	)
+
+	if host, ps, err = net.SplitHostPort(c.dstHost); err != nil || host == "" {
+		return ErrParseDstAddrInvalid
+	}
+
+	if port, err = net.LookupPort("tcp", ps); err != nil {
 		return ErrParseDstAddrInvalid
 	}
 
+	c.dstAddr = &net.TCPAddr{IP: net.ParseIP(host), Port: port}
+	c.dstIPs = nil
 	return nil
 }
 
+// prepareExchange overrides the destination, checks it and connects to it. the
+// domain is resolved here only for the direct connections or if the Cidrs of the
+// rules decide, the upstream proxies resolve the host by themselves
 func (c *conn) prepareExchange() error {
 	var (
+		d   Dialer
 		err error
 	)
 
-	if c.dstConn, err = net.DialTCP("tcp", nil, c.dstAddr); err != nil {
+	if err = c.overrideDst(); err != nil {
+		return err
+	}
+
+	if d, err = c.dialer(); err != nil {
+		return err
+	}
+
+	if err = c.checkAcl(); err != nil {
+		return err
+	}
+
+	if d == nil {
+		if err = c.resolveDst(); err != nil {
+			c.server.Log(err, c.dstHost)
+			return ErrPrepareExchangeHostUnReachable
+		}
+	}
+
+	if err = c.checkQuota(true); err != nil {
+		return err
+	}
+
+	if c.dstConn, err = c.dialDst(d); err != nil {
+		if errors.Is(err, ErrGuardBlocked) {
+			return ErrGuardBlocked
+		}
+
 		switch e := err.(type) {
 		case *net.OpError:
 			switch e.Err.(type) {
@@ -308,21 +418,75 @@ func (c *conn) prepareExchange() error {
 				return err
 			}
 		default:
-			return ErrPrepareExchangeGeneral
+			// such as the errors of upstream proxies
+			return err
 		}
 	}
 
 	return nil
 }
 
+// dialDst connects to the destination by ud, directly if it's nil. the host is
+// sent to the upstream proxy unresolved so it's resolved by the last hop. the
+// guard, TCP Fast Open and Happy Eyeballs are only applied to the direct connections
+func (c *conn) dialDst(ud Dialer) (net.Conn, error) {
+	var (
+		d = &DirectDialer{}
+	)
+
+	if ud != nil {
+		return ud.Dial(c.dstHost)
+	}
+
+	d.Control = func(network string, address string, rc syscall.RawConn) error {
+		if err := c.server.Cfg.guardControl(network, address, rc); err != nil {
+			return err
+		}
+
+		if c.fastOpen {
+			return fastOpenControl(network, address, rc)
+		}
+
+		return nil
+	}
+
+	return c.dialCandidates(d)
+}
+
+// prepareExchangeRep maps the error of prepareExchange to the replay field,
+// SOCKS6 shares the same codes with SOCKS5
+func prepareExchangeRep(err error) byte {
+	switch err {
+	case ErrAclDenied, ErrGuardBlocked, ErrRouteRejected,
+		ErrQuotaSessions, ErrQuotaConnectRate, ErrTrafficQuotaExceeded:
+		return repNotAllowed
+	case ErrPrepareExchangeATypNotSupported:
+		return repATypNotSupported
+	case ErrPrepareExchangeHostUnReachable:
+		return repHostUnReachable
+	case ErrPrepareExchangeNetUnReachable:
+		return repNetUnReachable
+	case ErrPrepareExchangeConnRefused:
+		return repConnRefused
+	default:
+		return repGeneralServerFailure
+	}
+}
+
 func (c *conn) exchange() error {
 	var (
-		wg     sync.WaitGroup
-		errL2R error
-		errR2L error
-		err    error
+		err error
 	)
 
+	switch c.version {
+	case version6:
+		return c.exchange6()
+	case version4:
+		return c.exchange4()
+	case versionHttp:
+		return c.exchangeHttp()
+	}
+
 	if err = c.parseCommand(); err != nil {
 		c.server.Log(err)
 
@@ -338,34 +502,54 @@ func (c *conn) exchange() error {
 		}
 	}
 
+	switch c.cmd {
+	case cmdBind:
+		return c.bind()
+	case cmdUdp:
+		return c.udpAssociate()
+	default:
+		return c.connect()
+	}
+}
+
+func (c *conn) connect() error {
+	var (
+		err error
+	)
+
 	if err = c.prepareExchange(); err != nil {
 		c.server.Log(err)
+		return c.writeCmdReplay(prepareExchangeRep(err))
+	}
 
-		switch err {
-		case ErrPrepareExchangeATypNotSupported:
-			return c.writeCmdReplay(repATypNotSupported)
-		case ErrPrepareExchangeHostUnReachable:
-			return c.writeCmdReplay(repHostUnReachable)
-		case ErrPrepareExchangeNetUnReachable:
-			return c.writeCmdReplay(repNetUnReachable)
-		case ErrPrepareExchangeConnRefused:
-			return c.writeCmdReplay(repConnRefused)
-		default:
-			return c.writeCmdReplay(repGeneralServerFailure)
-		}
+	if err = c.writeCmdReplay(repSucceeded); err != nil {
+		return err
 	}
 
-	c.writeCmdReplay(repSucceeded)
+	return c.relay()
+}
+
+// relay copies data between the client and c.dstConn until both directions are done
+func (c *conn) relay() error {
+	var (
+		wg     sync.WaitGroup
+		errL2R error
+		errR2L error
+		dst    io.Writer
+		clt    io.Writer
+	)
+
+	dst, clt = c.relayWriters(c.dstConn, c.netConn)
 
 	wg.Add(2)
 
 	go func() {
-		_, errL2R = io.Copy(c.dstConn, c.netConn)
+		_, errL2R = io.Copy(dst, c.br)
 		wg.Done()
 	}()
 
 	go func() {
-		_, errR2L = io.Copy(c.netConn, c.dstConn)
+		_, errR2L = io.Copy(clt, c.dstConn)
 		wg.Done()
 	}()
 
@@ -384,35 +568,29 @@ func (c *conn) exchange() error {
 
 func (c *conn) writeCmdReplay(repField byte) error {
 	var (
-		aTyp    byte
-		bndAddr []byte
-		bndPort []byte
-		lAddr   *net.TCPAddr
-		err     error
-		rep     []byte
-		port16  uint16
+		lAddr *net.TCPAddr
 	)
 
-	rep = []byte{version5, repField, reqRsv}
-
 	if c.dstConn != nil {
-		lAddr = c.dstConn.LocalAddr().(*net.TCPAddr)
-		if lAddr.Zone == "" {
-			aTyp = aTypIpv4
-		} else {
-			aTyp = aTypIpv6
-		}
+		lAddr = tcpAddrOf(c.dstConn.LocalAddr())
+	}
 
-		rep = append(rep, aTyp)
+	return c.writeCmdReplayAddr(repField, lAddr)
+}
 
-		bndAddr = []byte(lAddr.IP)
-		rep = append(rep, bndAddr...)
+// writeCmdReplayAddr writes a replay with the given BND.ADDR and BND.PORT,
+// a nil addr is sent as 0.0.0.0:0
+func (c *conn) writeCmdReplayAddr(repField byte, addr *net.TCPAddr) error {
+	var (
+		err error
+		rep []byte
+	)
 
-		port16 = uint16(lAddr.Port)
-		bndPort = make([]byte, 2)
-		bndPort[0] = byte(port16)
-		bndPort[1] = byte(port16 >> 8)
-		rep = append(rep, bndPort...)
+	rep = []byte{version5, repField, reqRsv}
+	if addr == nil {
+		rep = appendAddr(rep, nil, 0)
+	} else {
+		rep = appendAddr(rep, addr.IP, addr.Port)
 	}
 
 	if _, err = c.netConn.Write(rep); err != nil {
@@ -426,6 +604,27 @@ func (c *conn) writeCmdReplay(repField byte) error {
 	return nil
 }
 
+// appendAddr appends ATYP, ADDR and PORT in the socks5 wire format
+func appendAddr(b []byte, ip net.IP, port int) []byte {
+	var (
+		ip4 net.IP
+	)
+
+	if ip4 = ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+
+		b = append(b, aTypIpv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, aTypIpv6)
+		b = append(b, ip.To16()...)
+	}
+
+	return append(b, byte(port>>8), byte(port))
+}
+
 func (c *conn) writeNegotiateReplay(method byte) error {
 	if _, err := c.netConn.Write([]byte{version5, method}); err != nil {
 		return ErrNegotiateWriteReplay
@@ -453,11 +652,17 @@ func (c *conn) writeAuthUnPwdReplay(ok bool) error {
 	return nil
 }
 
-func (c *conn) close() {
+func (c *conn) closeDst() {
 	if c.dstConn != nil {
 		c.dstConn.Close()
 		c.dstConn = nil
 	}
+}
+
+func (c *conn) close() {
+	c.closeDst()
+	c.releaseQuota()
+	c.flushTraffic()
 
 	if c.netConn != nil {
 		c.netConn.Close()
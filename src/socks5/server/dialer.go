@@ -0,0 +1,420 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	upstreamTypeSocks5 = "socks5"
+	upstreamTypeHttp   = "http"
+
+	upstreamHandshakeTimeout = 30 * time.Second
+)
+
+var (
+	ErrUpstreamInvalidType   = errors.New("Upstream: Type should be \"socks5\" or \"http\".")
+	ErrUpstreamInvalidAddr   = errors.New("Upstream: invalid Addr.")
+	ErrUpstreamEmptyChain    = errors.New("Upstream: a chain should have at least one hop.")
+	ErrUpstreamUnknown       = errors.New("Upstream: DefaultUpstream is not in Upstreams or UpstreamPools.")
+	ErrUpstreamHandshake     = errors.New("Upstream: handshake with the proxy failed.")
+	ErrUpstreamNoAuthMethod  = errors.New("Upstream: no acceptable auth method.")
+	ErrUpstreamAuthFailed    = errors.New("Upstream: authentication failed.")
+	ErrUpstreamConnectFailed = errors.New("Upstream: the proxy failed to connect.")
+	ErrUpstreamHopFailed     = errors.New("Upstream: the proxy failed to connect to the next hop.")
+)
+
+// Dialer connects to addr, "host:port", over TCP. the host can be a domain
+// which is resolved by the dialer, or by the last proxy of a chain
+type Dialer interface {
+	Dial(addr string) (net.Conn, error)
+}
+
+// DirectDialer connects to addr by itself, Control is used as net.Dialer.Control
+type DirectDialer struct {
+	Control func(network string, address string, rc syscall.RawConn) error
+}
+
+func (d *DirectDialer) Dial(addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+func (d *DirectDialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	nd := &net.Dialer{Control: d.Control}
+	return nd.DialContext(ctx, "tcp", addr)
+}
+
+// Socks5Dialer connects to addr through a SOCKS5 proxy at Addr which is reached
+// by Forward, directly if it's nil. USERNAME/PASSWORD is used if Username isn't empty
+type Socks5Dialer struct {
+	Addr     string
+	Username string
+	Password string
+	Forward  Dialer
+}
+
+func (d *Socks5Dialer) Dial(addr string) (net.Conn, error) {
+	var (
+		nc  net.Conn
+		err error
+	)
+
+	if nc, err = forwardDial(d.Forward, d.Addr); err != nil {
+		return nil, err
+	}
+
+	nc.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	if err = d.handshake(nc, addr); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	nc.SetDeadline(time.Time{})
+	return nc, nil
+}
+
+func (d *Socks5Dialer) handshake(nc net.Conn, addr string) error {
+	var (
+		buf     = make([]byte, 262)
+		methods = []byte{authMethodBare}
+		host    string
+		port    int
+		req     []byte
+		err     error
+	)
+
+	if host, port, err = splitDstAddr(addr); err != nil {
+		return err
+	}
+
+	if d.Username != "" {
+		methods = []byte{authMethodUnPwd}
+	}
+
+	if _, err = nc.Write(append([]byte{version5, byte(len(methods))}, methods...)); err != nil {
+		return ErrUpstreamHandshake
+	}
+
+	if _, err = io.ReadFull(nc, buf[:2]); err != nil || buf[0] != version5 {
+		return ErrUpstreamHandshake
+	}
+
+	switch buf[1] {
+	case authMethodBare:
+	case authMethodUnPwd:
+		if d.Username == "" || len(d.Username) > 255 || len(d.Password) > 255 {
+			return ErrUpstreamNoAuthMethod
+		}
+
+		req = append([]byte{authMethodUnPwdVersion, byte(len(d.Username))}, d.Username...)
+		req = append(append(req, byte(len(d.Password))), d.Password...)
+		if _, err = nc.Write(req); err != nil {
+			return ErrUpstreamHandshake
+		}
+
+		if _, err = io.ReadFull(nc, buf[:2]); err != nil {
+			return ErrUpstreamHandshake
+		}
+
+		if buf[1] != authMethodUnPwdStatusSucceed {
+			return ErrUpstreamAuthFailed
+		}
+	default:
+		return ErrUpstreamNoAuthMethod
+	}
+
+	req = []byte{version5, cmdConnect, reqRsv}
+	if ip := net.ParseIP(host); ip != nil {
+		req = appendAddr(req, ip, port)
+	} else {
+		req = append(append(req, aTypDomain, byte(len(host))), host...)
+		req = append(req, byte(port>>8), byte(port))
+	}
+
+	if _, err = nc.Write(req); err != nil {
+		return ErrUpstreamHandshake
+	}
+
+	// the replay is VER, REP, RSV, ATYP, BND.ADDR and BND.PORT
+	if _, err = io.ReadFull(nc, buf[:5]); err != nil || buf[0] != version5 {
+		return ErrUpstreamHandshake
+	}
+
+	if buf[1] != repSucceeded {
+		return ErrUpstreamConnectFailed
+	}
+
+	switch buf[3] {
+	case aTypIpv4:
+		_, err = io.ReadFull(nc, buf[5:4+net.IPv4len+2])
+	case aTypIpv6:
+		_, err = io.ReadFull(nc, buf[5:4+net.IPv6len+2])
+	case aTypDomain:
+		_, err = io.ReadFull(nc, buf[5:5+int(buf[4])+2])
+	default:
+		return ErrUpstreamHandshake
+	}
+
+	if err != nil {
+		return ErrUpstreamHandshake
+	}
+
+	return nil
+}
+
+// HttpDialer connects to addr through an HTTP proxy at Addr by the CONNECT
+// method, Basic auth is used if Username isn't empty
+type HttpDialer struct {
+	Addr     string
+	Username string
+	Password string
+	Forward  Dialer
+}
+
+func (d *HttpDialer) Dial(addr string) (net.Conn, error) {
+	var (
+		nc  net.Conn
+		br  *bufio.Reader
+		rep *http.Response
+		req = &http.Request{
+			Method: http.MethodConnect,
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		err error
+	)
+
+	if nc, err = forwardDial(d.Forward, d.Addr); err != nil {
+		return nil, err
+	}
+
+	req.URL = &url.URL{Host: addr}
+	if d.Username != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(d.Username+":"+d.Password)))
+	}
+
+	nc.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	if err = req.Write(nc); err != nil {
+		nc.Close()
+		return nil, ErrUpstreamHandshake
+	}
+
+	br = bufio.NewReader(nc)
+	if rep, err = http.ReadResponse(br, req); err != nil {
+		nc.Close()
+		return nil, ErrUpstreamHandshake
+	}
+
+	rep.Body.Close()
+
+	switch {
+	case rep.StatusCode == http.StatusProxyAuthRequired:
+		nc.Close()
+		return nil, ErrUpstreamAuthFailed
+	case rep.StatusCode/100 != 2:
+		nc.Close()
+		return nil, ErrUpstreamConnectFailed
+	}
+
+	nc.SetDeadline(time.Time{})
+
+	// the data from the destination may be read along with the response
+	if br.Buffered() > 0 {
+		return &bufConn{nc, br}, nil
+	}
+
+	return nc, nil
+}
+
+// bufConn is the net.Conn whose first bytes are buffered in br
+type bufConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (bc *bufConn) Read(b []byte) (int, error) {
+	return bc.br.Read(b)
+}
+
+// forwardDial connects to the proxy at addr by d, ErrUpstreamConnectFailed is
+// only returned for the destination so the failure of a previous hop to reach
+// the proxy is ErrUpstreamHopFailed
+func forwardDial(d Dialer, addr string) (net.Conn, error) {
+	if d == nil {
+		d = &DirectDialer{}
+	}
+
+	nc, err := d.Dial(addr)
+	if err == ErrUpstreamConnectFailed {
+		return nil, ErrUpstreamHopFailed
+	}
+
+	return nc, err
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	var (
+		host string
+		ps   string
+		port int
+		err  error
+	)
+
+	if host, ps, err = net.SplitHostPort(addr); err != nil {
+		return "", 0, ErrUpstreamInvalidAddr
+	}
+
+	if port, err = strconv.Atoi(ps); err != nil || port <= 0 || port > 65535 {
+		return "", 0, ErrUpstreamInvalidAddr
+	}
+
+	return host, port, nil
+}
+
+// splitDstAddr splits the destination asked by the client, the domain should fit
+// in the SOCKS5 request
+func splitDstAddr(addr string) (string, int, error) {
+	host, port, err := splitHostPort(addr)
+	if err == nil && net.ParseIP(host) == nil && len(host) > 255 {
+		err = ErrUpstreamInvalidAddr
+	}
+
+	return host, port, err
+}
+
+// UpstreamHop is a proxy of an upstream chain, Type is "socks5" or "http"
+type UpstreamHop struct {
+	Type     string `json:"Type"`
+	Addr     string `json:"Addr"`
+	Username string `json:"Username"`
+	Password string `json:"Password"`
+}
+
+func (h *UpstreamHop) check() error {
+	switch h.Type {
+	case upstreamTypeSocks5, upstreamTypeHttp:
+	default:
+		return ErrUpstreamInvalidType
+	}
+
+	if _, _, err := splitHostPort(h.Addr); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// newChainDialer returns the dialer which goes through the hops in order, the
+// first hop is connected directly
+func newChainDialer(hops []*UpstreamHop) Dialer {
+	var (
+		d Dialer
+	)
+
+	for _, h := range hops {
+		switch h.Type {
+		case upstreamTypeSocks5:
+			d = &Socks5Dialer{Addr: h.Addr, Username: h.Username, Password: h.Password, Forward: d}
+		case upstreamTypeHttp:
+			d = &HttpDialer{Addr: h.Addr, Username: h.Username, Password: h.Password, Forward: d}
+		}
+	}
+
+	return d
+}
+
+func (c *Config) checkUpstreams() error {
+	for _, hops := range c.Upstreams {
+		if len(hops) == 0 {
+			return ErrUpstreamEmptyChain
+		}
+
+		for _, h := range hops {
+			if err := h.check(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := c.checkPools(); err != nil {
+		return err
+	}
+
+	if c.DefaultUpstream != "" && !c.hasUpstream(c.DefaultUpstream) {
+		return ErrUpstreamUnknown
+	}
+
+	return nil
+}
+
+// upstream returns the dialer of the named chain, nil means to connect directly
+func (c *Config) upstream(name string) Dialer {
+	if hops, ok := c.Upstreams[name]; ok {
+		return newChainDialer(hops)
+	}
+
+	return nil
+}
+
+// dialer returns the dialer of the destination by the route rules, nil means
+// to connect directly. Server.Dialer overrides the routes other than reject
+func (c *conn) dialer() (Dialer, error) {
+	var (
+		cfg  = c.server.Cfg
+		host string
+		r    *RouteRule
+		err  error
+	)
+
+	if host, _, err = net.SplitHostPort(c.dstHost); err != nil {
+		host = c.dstHost
+	}
+
+	// the domain is only resolved here if the Cidrs of the rules decide, otherwise
+	// it's left to the upstream if it's routed to one
+	if c.dstAddr.IP == nil && cfg.routeNeedsIp(c.userName(), host, c.dstAddr.Port) {
+		if err = c.resolveDst(); err != nil {
+			c.server.Log(err, c.dstHost)
+			return nil, ErrPrepareExchangeHostUnReachable
+		}
+	}
+
+	if r, err = cfg.route(c.userName(), host, c.dstAddr.IP, c.dstAddr.Port); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case r != nil && r.Action == routeActionReject:
+		return nil, ErrRouteRejected
+	case c.server.Dialer != nil:
+		return c.server.Dialer, nil
+	case r == nil:
+		return c.server.upstream(cfg.DefaultUpstream), nil
+	}
+
+	switch r.Action {
+	case routeActionUpstream:
+		return c.server.upstream(r.Upstream), nil
+	}
+
+	return nil, nil
+}
+
+// tcpAddrOf returns addr if it's a TCP address, the local address of a conn
+// created by a Dialer may not be one
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		return ta
+	}
+
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamChain(t *testing.T) {
+	var (
+		echo  = listenEcho(t)
+		socks = listenServer(t, &Config{AuthMethods: []uint8{authMethodUnPwd}, UsrPwdPairs: UsrPwdPairs{"Usr1": "Pwd1"}})
+		proxy = listenServer(t, &Config{})
+		front = listenServer(t, &Config{
+			Upstreams: map[string][]*UpstreamHop{
+				"chain": {
+					{Type: upstreamTypeHttp, Addr: proxy.Addr().String()},
+					{Type: upstreamTypeSocks5, Addr: socks.Addr().String(), Username: "Usr1", Password: "Pwd1"},
+				},
+			},
+			DefaultUpstream: "chain",
+		})
+		port = echo.Addr().(*net.TCPAddr).Port
+		nc   net.Conn
+		buf  = make([]byte, 10)
+		err  error
+	)
+
+	defer echo.Close()
+	defer socks.Close()
+	defer proxy.Close()
+	defer front.Close()
+
+	if nc, err = net.Dial("tcp", front.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	nc.Write([]byte{version5, 1, authMethodBare})
+	if _, err = io.ReadFull(nc, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	nc.Write(append(append([]byte{version5, cmdConnect, reqRsv, aTypDomain, 9}, "localhost"...), byte(port>>8), byte(port)))
+	if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != repSucceeded {
+		t.Fatal("Unexpected replay", buf, err)
+	}
+
+	nc.Write([]byte("hello"))
+	if _, err = io.ReadFull(nc, buf[:5]); err != nil || string(buf[:5]) != "hello" {
+		t.Fatal("Unexpected echo", buf[:5], err)
+	}
+}
+
+func TestUpstreamAuthFailed(t *testing.T) {
+	var (
+		socks = listenServer(t, &Config{AuthMethods: []uint8{authMethodUnPwd}, UsrPwdPairs: UsrPwdPairs{"Usr1": "Pwd1"}})
+		d     = &Socks5Dialer{Addr: socks.Addr().String(), Username: "Usr1", Password: "wrong"}
+		err   error
+	)
+
+	defer socks.Close()
+
+	if _, err = d.Dial("127.0.0.1:1"); err != ErrUpstreamAuthFailed {
+		t.Fatal("Expected the authentication to fail", err)
+	}
+}
+
+func TestUpstreamCheck(t *testing.T) {
+	var (
+		cases = map[*Config]error{
+			{Upstreams: map[string][]*UpstreamHop{"a": {}}}:                                       ErrUpstreamEmptyChain,
+			{Upstreams: map[string][]*UpstreamHop{"a": {{Type: "socks4", Addr: "1.2.3.4:1080"}}}}: ErrUpstreamInvalidType,
+			{Upstreams: map[string][]*UpstreamHop{"a": {{Type: "http", Addr: "1.2.3.4"}}}}:        ErrUpstreamInvalidAddr,
+			{DefaultUpstream: "a"}: ErrUpstreamUnknown,
+		}
+	)
+
+	for cfg, expected := range cases {
+		if err := cfg.checkUpstreams(); err != expected {
+			t.Fatal("Unexpected result", err, expected)
+		}
+	}
+}
+
+func TestUpstreamSkipsLookup(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		// only the resolver of the upstream knows cola.test
+		upDns, _ = countingDns(t, map[string][]net.IP{"cola.test": {net.IPv4(127, 0, 0, 1)}})
+		socks    = listenServer(t, &Config{
+			Resolvers:       map[string]*ResolverConfig{"up": {Type: resolverTypeTcp, Servers: []string{upDns.Addr().String()}}},
+			DefaultResolver: "up",
+		})
+		dns, n  = countingDns(t, map[string][]net.IP{})
+		resolve = map[string]*ResolverConfig{"local": {Type: resolverTypeTcp, Servers: []string{dns.Addr().String()}}}
+		ups     = map[string][]*UpstreamHop{"up": {{Type: upstreamTypeSocks5, Addr: socks.Addr().String()}}}
+		front   = listenServer(t, &Config{Upstreams: ups, DefaultUpstream: "up", Resolvers: resolve, DefaultResolver: "local"})
+		strict  = listenServer(t, &Config{
+			Upstreams:       ups,
+			DefaultUpstream: "up",
+			Resolvers:       resolve,
+			DefaultResolver: "local",
+			AclRules:        []*AclRule{{Action: aclActionDeny, Cidrs: []string{"10.0.0.0/8"}}},
+		})
+		port = echo.Addr().(*net.TCPAddr).Port
+	)
+
+	defer echo.Close()
+	defer upDns.Close()
+	defer socks.Close()
+	defer dns.Close()
+	defer front.Close()
+	defer strict.Close()
+
+	connect := func(srv net.Listener) byte {
+		var (
+			buf = make([]byte, 10)
+		)
+
+		nc, err := net.Dial("tcp", srv.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer nc.Close()
+
+		nc.Write([]byte{version5, 1, authMethodBare})
+		if _, err = io.ReadFull(nc, buf[:2]); err != nil {
+			t.Fatal(err)
+		}
+
+		nc.Write(append(append([]byte{version5, cmdConnect, reqRsv, aTypDomain, 9}, "cola.test"...), byte(port>>8), byte(port)))
+		if _, err = io.ReadFull(nc, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		return buf[1]
+	}
+
+	if rep := connect(front); rep != repSucceeded || atomic.LoadInt32(n) != 0 {
+		t.Fatal("Expected the upstream to resolve the domain", rep, atomic.LoadInt32(n))
+	}
+
+	// the local resolver knows nothing so the Cidrs of the ACL fail closed
+	if rep := connect(strict); rep != repNotAllowed || atomic.LoadInt32(n) == 0 {
+		t.Fatal("Expected the unresolved domain to be denied", rep, atomic.LoadInt32(n))
+	}
+}
+
+// countingDialer connects directly and counts the dials
+type countingDialer struct {
+	n int32
+}
+
+func (d *countingDialer) Dial(addr string) (net.Conn, error) {
+	atomic.AddInt32(&d.n, 1)
+	return net.Dial("tcp", addr)
+}
+
+func TestServerDialerRejectRoute(t *testing.T) {
+	var (
+		rejected = listenEcho(t)
+		allowed  = listenEcho(t)
+		port     = rejected.Addr().(*net.TCPAddr).Port
+		d        = &countingDialer{}
+		cfg      = &Config{RouteRules: []*RouteRule{{Action: routeActionReject, Ports: []string{strconv.Itoa(port)}}}}
+		l        net.Listener
+		err      error
+	)
+
+	defer rejected.Close()
+	defer allowed.Close()
+
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	cfg.DstGuardAllow = []string{"127.0.0.0/8"}
+	go (&Server{Cfg: cfg, Dialer: d, StartTime: time.Now()}).Serve(l)
+
+	for _, c := range []struct {
+		port int
+		rep  byte
+	}{{port, repNotAllowed}, {allowed.Addr().(*net.TCPAddr).Port, repSucceeded}} {
+		var (
+			nc  net.Conn
+			buf = make([]byte, 10)
+		)
+
+		if nc, err = net.Dial("tcp", l.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+
+		nc.Write([]byte{version5, 1, authMethodBare})
+		if _, err = io.ReadFull(nc, buf[:2]); err != nil {
+			t.Fatal(err)
+		}
+
+		nc.Write([]byte{version5, cmdConnect, reqRsv, aTypIpv4, 127, 0, 0, 1, byte(c.port >> 8), byte(c.port)})
+		_, err = io.ReadFull(nc, buf)
+		nc.Close()
+
+		if err != nil || buf[1] != c.rep {
+			t.Fatal("Unexpected replay of port", c.port, buf, err)
+		}
+	}
+
+	if atomic.LoadInt32(&d.n) != 1 {
+		t.Fatal("Expected only the destination not rejected to be dialed by Server.Dialer", d.n)
+	}
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsCacheDefaultSize   = 4096
+	dnsCacheDefaultMaxTtl = time.Hour
+	dnsCacheNegativeTtl   = 30 * time.Second
+	// the TTL of the answers of the system resolver is unknown
+	dnsCacheUnknownTtl = time.Minute
+
+	dnsTypeSoa = 6
+)
+
+var (
+	ErrDnsCacheInvalidTtl = errors.New("Config: DnsCacheMinTtl should not be greater than DnsCacheMaxTtl.")
+)
+
+// DnsCacheStats is the statistics of the DNS caches of all resolvers, NegativeHits
+// are the hits of the cached NXDOMAIN answers and they are counted in Hits as well
+type DnsCacheStats struct {
+	Hits         int64 `json:"Hits"`
+	Misses       int64 `json:"Misses"`
+	NegativeHits int64 `json:"NegativeHits"`
+	Evictions    int64 `json:"Evictions"`
+	Entries      int   `json:"Entries"`
+}
+
+func (c *Config) checkDnsCache() error {
+	if c.DnsCacheMaxTtl != 0 && c.DnsCacheMinTtl > c.DnsCacheMaxTtl {
+		return ErrDnsCacheInvalidTtl
+	}
+
+	return nil
+}
+
+func (c *Config) dnsCacheSize() int {
+	if c.DnsCacheSize == 0 {
+		return dnsCacheDefaultSize
+	}
+
+	return int(c.DnsCacheSize)
+}
+
+func (c *Config) dnsCacheMaxTtl() time.Duration {
+	if c.DnsCacheMaxTtl == 0 {
+		return dnsCacheDefaultMaxTtl
+	}
+
+	return time.Duration(c.DnsCacheMaxTtl) * time.Second
+}
+
+func (c *Config) dnsCacheNegativeTtl() time.Duration {
+	if c.DnsCacheNegativeTtl == 0 {
+		return dnsCacheNegativeTtl
+	}
+
+	return time.Duration(c.DnsCacheNegativeTtl) * time.Second
+}
+
+// clampTtl applies DnsCacheMinTtl and DnsCacheMaxTtl to ttl
+func (c *Config) clampTtl(ttl time.Duration) time.Duration {
+	if min := time.Duration(c.DnsCacheMinTtl) * time.Second; ttl < min {
+		ttl = min
+	}
+
+	if max := c.dnsCacheMaxTtl(); ttl > max {
+		ttl = max
+	}
+
+	return ttl
+}
+
+// dnsCache is a LRU cache of the answers shared by the resolvers of a config,
+// the entries are keyed by the resolver, the network and the host
+type dnsCache struct {
+	cfg     *Config
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   DnsCacheStats
+}
+
+type dnsCacheEntry struct {
+	key    string
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+func newDnsCache(cfg *Config) *dnsCache {
+	return &dnsCache{
+		cfg:     cfg,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (dc *dnsCache) get(key string) (*dnsCacheEntry, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	el, ok := dc.entries[key]
+	if !ok {
+		dc.stats.Misses++
+		return nil, false
+	}
+
+	e := el.Value.(*dnsCacheEntry)
+	if time.Now().After(e.expire) {
+		dc.lru.Remove(el)
+		delete(dc.entries, key)
+		dc.stats.Misses++
+		return nil, false
+	}
+
+	dc.lru.MoveToFront(el)
+	dc.stats.Hits++
+	if e.err != nil {
+		dc.stats.NegativeHits++
+	}
+
+	return e, true
+}
+
+func (dc *dnsCache) put(e *dnsCacheEntry) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if el, ok := dc.entries[e.key]; ok {
+		el.Value = e
+		dc.lru.MoveToFront(el)
+		return
+	}
+
+	dc.entries[e.key] = dc.lru.PushFront(e)
+	for dc.lru.Len() > dc.cfg.dnsCacheSize() {
+		el := dc.lru.Back()
+		dc.lru.Remove(el)
+		delete(dc.entries, el.Value.(*dnsCacheEntry).key)
+		dc.stats.Evictions++
+	}
+}
+
+func (dc *dnsCache) Stats() DnsCacheStats {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	stats := dc.stats
+	stats.Entries = dc.lru.Len()
+	return stats
+}
+
+// cachedResolver looks up by r and caches the answers for their TTLs, only
+// NXDOMAIN is cached among the errors
+type cachedResolver struct {
+	name  string
+	r     Resolver
+	cache *dnsCache
+}
+
+func (cr *cachedResolver) LookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	var (
+		key = cr.name + "|" + network + "|" + strings.ToLower(strings.TrimSuffix(host, "."))
+		col = &ttlCollector{}
+		e   *dnsCacheEntry
+		ips []net.IP
+		ttl time.Duration
+		ok  bool
+		err error
+	)
+
+	if e, ok = cr.cache.get(key); ok {
+		return append([]net.IP{}, e.ips...), e.err
+	}
+
+	ips, err = cr.r.LookupIP(context.WithValue(ctx, ttlCollectorKey{}, col), network, host)
+
+	switch de, isDnsErr := err.(*net.DNSError); {
+	case err == nil:
+		if ttl, ok = col.get(); !ok {
+			ttl = dnsCacheUnknownTtl
+		}
+	case isDnsErr && de.IsNotFound:
+		if ttl, ok = col.get(); !ok {
+			ttl = cr.cache.cfg.dnsCacheNegativeTtl()
+		}
+	default:
+		return nil, err
+	}
+
+	if ttl = cr.cache.cfg.clampTtl(ttl); ttl > 0 {
+		cr.cache.put(&dnsCacheEntry{key: key, ips: append([]net.IP{}, ips...), err: err, expire: time.Now().Add(ttl)})
+	}
+
+	return ips, err
+}
+
+type ttlCollectorKey struct{}
+
+// ttlCollector collects the min TTL of the DNS responses of a lookup, the
+// negative TTL of the SOA record is collected for the responses without answer
+type ttlCollector struct {
+	mu  sync.Mutex
+	ttl uint32
+	set bool
+}
+
+func (tc *ttlCollector) add(ttl uint32) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if !tc.set || ttl < tc.ttl {
+		tc.ttl, tc.set = ttl, true
+	}
+}
+
+func (tc *ttlCollector) get() (time.Duration, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	return time.Duration(tc.ttl) * time.Second, tc.set
+}
+
+// watchTtl makes the responses read from nc collected by the collector of ctx
+func watchTtl(ctx context.Context, nc net.Conn) net.Conn {
+	var (
+		col, _ = ctx.Value(ttlCollectorKey{}).(*ttlCollector)
+	)
+
+	if col == nil {
+		return nc
+	}
+
+	if uc, ok := nc.(*net.UDPConn); ok {
+		return &ttlPacketConn{uc, col}
+	}
+
+	return &ttlStreamConn{Conn: nc, col: col}
+}
+
+// ttlPacketConn is a net.PacketConn so the resolver still sends datagrams
+type ttlPacketConn struct {
+	*net.UDPConn
+	col *ttlCollector
+}
+
+func (pc *ttlPacketConn) Read(b []byte) (int, error) {
+	n, err := pc.UDPConn.Read(b)
+	if ttl, ok := parseDnsTtl(b[:n]); ok {
+		pc.col.add(ttl)
+	}
+
+	return n, err
+}
+
+// ttlStreamConn parses the length-prefixed responses read from the stream
+type ttlStreamConn struct {
+	net.Conn
+	col *ttlCollector
+	buf []byte
+}
+
+func (sc *ttlStreamConn) Read(b []byte) (int, error) {
+	n, err := sc.Conn.Read(b)
+
+	sc.buf = append(sc.buf, b[:n]...)
+	for len(sc.buf) >= 2 {
+		l := int(sc.buf[0])<<8 | int(sc.buf[1])
+		if len(sc.buf) < 2+l {
+			break
+		}
+
+		if ttl, ok := parseDnsTtl(sc.buf[2 : 2+l]); ok {
+			sc.col.add(ttl)
+		}
+
+		sc.buf = sc.buf[2+l:]
+	}
+
+	return n, err
+}
+
+// parseDnsTtl returns the min TTL of the answers of a response, or the negative
+// TTL of its SOA record if it has no answer, see RFC 2308
+func parseDnsTtl(msg []byte) (uint32, bool) {
+	var (
+		off     = 12
+		qdCount int
+		anCount int
+		nsCount int
+		ttl     uint32
+		found   bool
+	)
+
+	if len(msg) < 12 {
+		return 0, false
+	}
+
+	qdCount = int(msg[4])<<8 | int(msg[5])
+	anCount = int(msg[6])<<8 | int(msg[7])
+	nsCount = int(msg[8])<<8 | int(msg[9])
+
+	for i := 0; i < qdCount; i++ {
+		if off = skipDnsName(msg, off) + 4; off > len(msg) {
+			return 0, false
+		}
+	}
+
+	for i := 0; i < anCount+nsCount; i++ {
+		if off = skipDnsName(msg, off); off+10 > len(msg) {
+			return 0, false
+		}
+
+		var (
+			typ   = int(msg[off])<<8 | int(msg[off+1])
+			rrTtl = uint32(msg[off+4])<<24 | uint32(msg[off+5])<<16 | uint32(msg[off+6])<<8 | uint32(msg[off+7])
+			rdLen = int(msg[off+8])<<8 | int(msg[off+9])
+			rd    = off + 10
+		)
+
+		if off = rd + rdLen; off > len(msg) {
+			return 0, false
+		}
+
+		if i >= anCount {
+			if anCount > 0 || typ != dnsTypeSoa || rdLen < 4 {
+				continue
+			}
+
+			// the MINIMUM field is the last of the SOA record
+			if min := uint32(msg[off-4])<<24 | uint32(msg[off-3])<<16 | uint32(msg[off-2])<<8 | uint32(msg[off-1]); min < rrTtl {
+				rrTtl = min
+			}
+		}
+
+		if !found || rrTtl < ttl {
+			ttl, found = rrTtl, true
+		}
+	}
+
+	return ttl, found
+}
+
+// skipDnsName returns the offset after the name at off, it's out of msg if
+// the name is broken
+func skipDnsName(msg []byte, off int) int {
+	for off < len(msg) {
+		switch l := int(msg[off]); {
+		case l == 0:
+			return off + 1
+		case l&0xC0 == 0xC0:
+			return off + 2
+		default:
+			off += 1 + l
+		}
+	}
+
+	return len(msg) + 1
+}
+
+// DnsCacheStats returns the statistics of the DNS cache
+func (s *Server) DnsCacheStats() DnsCacheStats {
+	if s.Cfg.compile() != nil || s.Cfg.dnsCache == nil {
+		return DnsCacheStats{}
+	}
+
+	return s.Cfg.dnsCache.Stats()
+}
+
+// DnsCacheHandler serves the statistics of the DNS cache as JSON
+func (s *Server) DnsCacheHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.DnsCacheStats())
+	})
+}
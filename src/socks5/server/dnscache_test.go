@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingDns serves records over TCP and counts the queries
+func countingDns(t *testing.T, records map[string][]net.IP) (net.Listener, *int32) {
+	var (
+		n int32
+	)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&n, 1)
+			go serveDnsStream(c, records)
+		}
+	}()
+
+	return l, &n
+}
+
+func TestDnsCache(t *testing.T) {
+	var (
+		records = map[string][]net.IP{"cola.test": {net.IPv4(10, 9, 8, 7)}}
+		l, n    = countingDns(t, records)
+		cfg     = &Config{
+			Resolvers:       map[string]*ResolverConfig{"tcp": {Type: resolverTypeTcp, Servers: []string{l.Addr().String()}}},
+			DefaultResolver: "tcp",
+		}
+		s = &Server{Cfg: cfg}
+	)
+
+	defer l.Close()
+
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := cfg.resolver("", "cola.test", 80)
+	for i := 0; i < 3; i++ {
+		ips, err := r.LookupIP(context.Background(), "ip4", "cola.test.")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(records["cola.test"][0]) {
+			t.Fatal("Unexpected result", ips, err)
+		}
+	}
+
+	if atomic.LoadInt32(n) != 1 {
+		t.Fatal("Expected one query", atomic.LoadInt32(n))
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupIP(context.Background(), "ip4", "missing.test.")
+		if de, ok := err.(*net.DNSError); !ok || !de.IsNotFound {
+			t.Fatal("Expected NXDOMAIN", err)
+		}
+	}
+
+	if atomic.LoadInt32(n) != 2 {
+		t.Fatal("Expected NXDOMAIN to be cached", atomic.LoadInt32(n))
+	}
+
+	stats := s.DnsCacheStats()
+	if stats.Hits != 3 || stats.Misses != 2 || stats.NegativeHits != 1 || stats.Entries != 2 {
+		t.Fatal("Unexpected stats", stats)
+	}
+}
+
+func TestDnsCacheExpire(t *testing.T) {
+	var (
+		cfg   = &Config{DnsCacheSize: 2}
+		cache = newDnsCache(cfg)
+	)
+
+	cache.put(&dnsCacheEntry{key: "a", expire: time.Now().Add(-time.Second)})
+	if _, ok := cache.get("a"); ok {
+		t.Fatal("Expected the entry to expire")
+	}
+
+	cache.put(&dnsCacheEntry{key: "a", expire: time.Now().Add(time.Minute)})
+	cache.put(&dnsCacheEntry{key: "b", expire: time.Now().Add(time.Minute)})
+	cache.get("a")
+	cache.put(&dnsCacheEntry{key: "c", expire: time.Now().Add(time.Minute)})
+
+	if _, ok := cache.get("b"); ok {
+		t.Fatal("Expected the least recently used entry to be evicted")
+	}
+
+	if stats := cache.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Fatal("Unexpected stats", stats)
+	}
+}
+
+func TestDnsCacheTtl(t *testing.T) {
+	var (
+		cfg = &Config{DnsCacheMinTtl: 10, DnsCacheMaxTtl: 100}
+		// NXDOMAIN of "a." with the SOA record of "." whose TTL is 300 and MINIMUM is 60
+		nx = []byte{
+			0, 1, 0x81, 0x83, 0, 1, 0, 0, 0, 1, 0, 0,
+			1, 'a', 0, 0, 1, 0, 1,
+			0, 0, 6, 0, 1, 0, 0, 1, 44, 0, 22,
+			0, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0, 0, 0, 60,
+		}
+	)
+
+	if ttl, ok := parseDnsTtl(nx); !ok || ttl != 60 {
+		t.Fatal("Unexpected negative TTL", ttl, ok)
+	}
+
+	if ttl, ok := parseDnsTtl(dnsAnswer(nx[:19], map[string][]net.IP{"a": {net.IPv4(1, 2, 3, 4)}})); !ok || ttl != 60 {
+		t.Fatal("Unexpected TTL", ttl, ok)
+	}
+
+	if cfg.clampTtl(time.Second) != 10*time.Second || cfg.clampTtl(time.Hour) != 100*time.Second {
+		t.Fatal("Expected TTL to be clamped")
+	}
+
+	if (&Config{DnsCacheMinTtl: 10, DnsCacheMaxTtl: 5}).checkDnsCache() != ErrDnsCacheInvalidTtl {
+		t.Fatal("Expected invalid TTLs")
+	}
+}
+
+func TestDnsCacheCompiledOnce(t *testing.T) {
+	var (
+		cfg = &Config{Resolvers: map[string]*ResolverConfig{"a": {Servers: []string{"10.0.0.53"}}}}
+	)
+
+	if err := cfg.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, r := cfg.dnsCache, cfg.resolvers["a"]
+	if cfg.compile() != nil || cfg.dnsCache != cache || cfg.resolvers["a"] != r {
+		t.Fatal("Expected the resolvers and the cache of check to be kept")
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	familyIpv4     = "ipv4"
+	familyIpv6     = "ipv6"
+	familyIpv4Only = "ipv4only"
+	familyIpv6Only = "ipv6only"
+
+	// the Connection Attempt Delay, see https://tools.ietf.org/html/rfc8305#section-5
+	defaultConnectAttemptDelay = 250 * time.Millisecond
+)
+
+var (
+	ErrCfgInvalidPreferFamily = errors.New("Config: PreferFamily should be one of \"\", \"ipv4\", \"ipv6\", \"ipv4only\" and \"ipv6only\".")
+)
+
+func (c *Config) checkPreferFamily() error {
+	switch c.PreferFamily {
+	case "", familyIpv4, familyIpv6, familyIpv4Only, familyIpv6Only:
+		return nil
+	}
+
+	return ErrCfgInvalidPreferFamily
+}
+
+func (c *Config) connectAttemptDelay() time.Duration {
+	if c.ConnectAttemptDelay == 0 {
+		return defaultConnectAttemptDelay
+	}
+
+	return time.Duration(c.ConnectAttemptDelay) * time.Millisecond
+}
+
+// sortByFamily orders the resolved ips to connect, the families are interleaved
+// starting with the preferred one, IPv6 by default, see https://tools.ietf.org/html/rfc8305#section-4.
+// the other family is dropped if only one is allowed
+func (c *Config) sortByFamily(ips []net.IP) []net.IP {
+	var (
+		v4     []net.IP
+		v6     []net.IP
+		sorted []net.IP
+	)
+
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	first, second := v6, v4
+	switch c.PreferFamily {
+	case familyIpv4:
+		first, second = v4, v6
+	case familyIpv4Only:
+		first, second = v4, nil
+	case familyIpv6Only:
+		first, second = v6, nil
+	}
+
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+
+	return sorted
+}
+
+// resolveDst looks up the candidates of the destination in the order to connect,
+// c.dstAddr.IP is set to the first one which is checked by the ACL and route rules.
+// it's done once until resolveDstAddr parses another destination
+func (c *conn) resolveDst() error {
+	var (
+		host string
+		ips  []net.IP
+		err  error
+	)
+
+	if c.dstIPs != nil {
+		return nil
+	}
+
+	if c.dstAddr.IP != nil {
+		c.dstIPs = []net.IP{c.dstAddr.IP}
+		return nil
+	}
+
+	if host, _, err = net.SplitHostPort(c.dstHost); err != nil {
+		return ErrParseDstAddrInvalid
+	}
+
+	if ips, err = c.lookupHosts(host, c.dstAddr.Port); err != nil {
+		return err
+	}
+
+	c.dstIPs = ips
+	c.dstAddr.IP = ips[0]
+	return nil
+}
+
+// hasIP reports whether ip is in ips
+func hasIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dialCandidates connects to one of c.dstIPs allowed by the ACL with Happy Eyeballs
+func (c *conn) dialCandidates(d *DirectDialer) (net.Conn, error) {
+	var (
+		cfg   = c.server.Cfg
+		host  string
+		addrs []string
+		err   error
+	)
+
+	if host, _, err = net.SplitHostPort(c.dstHost); err != nil {
+		host = c.dstHost
+	}
+
+	for _, ip := range c.dstIPs {
+		if cfg.allowDst(c.userName(), host, ip, c.dstAddr.Port) {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(c.dstAddr.Port)))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, ErrAclDenied
+	}
+
+	return dialHappyEyeballs(context.Background(), d.DialContext, addrs, cfg.connectAttemptDelay())
+}
+
+// dialHappyEyeballs connects to addrs in turn, the next attempt starts once the
+// previous one fails or after delay while it's still pending. the first established
+// connection wins and the others are canceled, see https://tools.ietf.org/html/rfc8305#section-5.
+// the error of the first failed attempt is returned if all of them fail
+func dialHappyEyeballs(ctx context.Context, dial func(ctx context.Context, addr string) (net.Conn, error), addrs []string, delay time.Duration) (net.Conn, error) {
+	type result struct {
+		nc  net.Conn
+		err error
+	}
+
+	var (
+		// buffered so the attempts losing the race never block
+		results  = make(chan result, len(addrs))
+		next     int
+		pending  int
+		firstErr error
+		timeout  <-chan time.Time
+		cancel   context.CancelFunc
+	)
+
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+
+	start := func() {
+		go func(addr string) {
+			nc, err := dial(ctx, addr)
+			results <- result{nc, err}
+		}(addrs[next])
+
+		next++
+		pending++
+
+		if timeout = nil; next < len(addrs) {
+			timeout = time.After(delay)
+		}
+	}
+
+	start()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.nc != nil {
+							r.nc.Close()
+						}
+					}
+				}(pending)
+
+				return r.nc, nil
+			}
+
+			if firstErr == nil {
+				firstErr = r.err
+			}
+
+			if next < len(addrs) {
+				start()
+			}
+		case <-timeout:
+			start()
+		}
+	}
+
+	return nil, firstErr
+}
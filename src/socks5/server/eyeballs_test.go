@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSortByFamily(t *testing.T) {
+	var (
+		a4  = net.IPv4(10, 0, 0, 1)
+		b4  = net.IPv4(10, 0, 0, 2)
+		a6  = net.ParseIP("fd00::1")
+		ips = []net.IP{a4, b4, a6}
+	)
+
+	cases := map[string][]net.IP{
+		"":             {a6, a4, b4},
+		familyIpv4:     {a4, a6, b4},
+		familyIpv4Only: {a4, b4},
+		familyIpv6Only: {a6},
+	}
+
+	for family, expected := range cases {
+		sorted := (&Config{PreferFamily: family}).sortByFamily(ips)
+		if len(sorted) != len(expected) {
+			t.Fatal("Unexpected order", family, sorted)
+		}
+
+		for i := range sorted {
+			if !sorted[i].Equal(expected[i]) {
+				t.Fatal("Unexpected order", family, sorted)
+			}
+		}
+	}
+
+	if (&Config{PreferFamily: "ipv5"}).checkPreferFamily() != ErrCfgInvalidPreferFamily {
+		t.Fatal("Expected invalid PreferFamily")
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	var (
+		errFail  = errors.New("fail")
+		canceled = make(chan bool, 1)
+	)
+
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		switch addr {
+		case "slow":
+			<-ctx.Done()
+			canceled <- true
+			return nil, ctx.Err()
+		case "fail":
+			return nil, errFail
+		}
+
+		c, _ := net.Pipe()
+		return c, nil
+	}
+
+	start := time.Now()
+	if nc, err := dialHappyEyeballs(context.Background(), dial, []string{"fail", "ok"}, time.Hour); err != nil {
+		t.Fatal("Expected the next address after a failure", err)
+	} else {
+		nc.Close()
+	}
+
+	if nc, err := dialHappyEyeballs(context.Background(), dial, []string{"slow", "ok"}, 20*time.Millisecond); err != nil {
+		t.Fatal("Expected the next address after the delay", err)
+	} else {
+		nc.Close()
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the pending attempt to be canceled")
+	}
+
+	if time.Since(start) > time.Second {
+		t.Fatal("Expected the attempts to race")
+	}
+
+	if _, err := dialHappyEyeballs(context.Background(), dial, []string{"fail", "fail"}, time.Hour); err != errFail {
+		t.Fatal("Expected the error of the first attempt", err)
+	}
+}
+
+func TestDialCandidates(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		port = echo.Addr().(*net.TCPAddr).Port
+		c    = &conn{
+			server:  &Server{Cfg: &Config{DisableDstGuard: true, ConnectAttemptDelay: 5000}},
+			dstHost: net.JoinHostPort("cola.test", strconv.Itoa(port)),
+			dstAddr: &net.TCPAddr{Port: port},
+			// ::1 is tried first and refused since echo is only on 127.0.0.1
+			dstIPs: []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)},
+		}
+		start = time.Now()
+	)
+
+	defer echo.Close()
+
+	nc, err := c.dialDst(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nc.Close()
+
+	if time.Since(start) > time.Second {
+		t.Fatal("Expected the next address right after the failure")
+	}
+
+	c.dstIPs = []net.IP{net.IPv6loopback}
+	if _, err = c.dialDst(nil); err == nil {
+		t.Fatal("Expected the failure of the only address")
+	}
+}
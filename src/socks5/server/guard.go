@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var (
+	ErrGuardBlocked     = errors.New("Guard: destination is a special-purpose address.")
+	ErrGuardInvalidCidr = errors.New("Guard: invalid CIDR in DstGuardAllow.")
+)
+
+// specialNets are the special-purpose addresses which are refused by the guard,
+// see https://www.iana.org/assignments/iana-ipv4-special-registry and
+// https://www.iana.org/assignments/iana-ipv6-special-registry
+var specialNets = mustParseCidrs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.88.99.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"100::/64",
+	"2001::/23",
+	"2001:db8::/32",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCidrs(cidrs ...string) []*net.IPNet {
+	var (
+		nets []*net.IPNet
+	)
+
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+func (c *Config) compileGuard() error {
+	var (
+		n   *net.IPNet
+		err error
+	)
+
+	c.guardAllow = nil
+	for _, cidr := range c.DstGuardAllow {
+		if _, n, err = net.ParseCIDR(cidr); err != nil {
+			return ErrGuardInvalidCidr
+		}
+
+		c.guardAllow = append(c.guardAllow, n)
+	}
+
+	return nil
+}
+
+// guardAllows reports whether the guard allows to reach ip, IPv4-mapped IPv6
+// addresses are checked as IPv4
+func (c *Config) guardAllows(ip net.IP) bool {
+	if c.DisableDstGuard {
+		return true
+	}
+
+	if c.compile() != nil || ip == nil {
+		return false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, n := range c.guardAllow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	for _, n := range specialNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// guardControl is used as net.Dialer.Control, it checks the address which is
+// really connected to so DNS rebinding cannot get around the guard
+func (c *Config) guardControl(network string, address string, rc syscall.RawConn) error {
+	var (
+		host string
+		err  error
+	)
+
+	if host, _, err = net.SplitHostPort(address); err != nil {
+		return ErrGuardBlocked
+	}
+
+	if !c.guardAllows(net.ParseIP(host)) {
+		return ErrGuardBlocked
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGuardAllows(t *testing.T) {
+	var (
+		cfg   = &Config{DstGuardAllow: []string{"10.1.0.0/16"}}
+		cases = map[string]bool{
+			"127.0.0.1":       false,
+			"169.254.169.254": false,
+			"192.168.1.1":     false,
+			"::1":             false,
+			"fe80::1":         false,
+			"::ffff:10.0.0.1": false,
+			"10.1.2.3":        true,
+			"::ffff:10.1.2.3": true,
+			"8.8.8.8":         true,
+			"2606:4700::1111": true,
+		}
+	)
+
+	for ip, ok := range cases {
+		if cfg.guardAllows(net.ParseIP(ip)) != ok {
+			t.Fatal("Unexpected result of", ip)
+		}
+	}
+}
+
+func TestGuardBlocksLoopback(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		srv  net.Listener
+		port = echo.Addr().(*net.TCPAddr).Port
+		nc   net.Conn
+		buf  = make([]byte, 10)
+		err  error
+	)
+
+	defer echo.Close()
+
+	if srv, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer srv.Close()
+	go (&Server{Cfg: &Config{}, StartTime: time.Now()}).Serve(srv)
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	nc.Write([]byte{version5, 1, authMethodBare})
+	if _, err = io.ReadFull(nc, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	nc.Write(append(append([]byte{version5, cmdConnect, reqRsv, aTypDomain, 9}, "localhost"...), byte(port>>8), byte(port)))
+
+	if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != repNotAllowed {
+		t.Fatal("Expected the destination to be blocked", buf, err)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrCfgInvalidHostOverride = errors.New("Config: invalid entry in HostOverrides.")
+)
+
+// normalizeHostKey returns the canonical form of "host" or "host:port", domains
+// are lower cased without the trailing dot and IPs are formatted by net.IP
+func normalizeHostKey(s string) (string, error) {
+	var (
+		host = s
+		ps   string
+		port int
+		err  error
+	)
+
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, ps = h, p
+	}
+
+	if host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), "."); host == "" {
+		return "", ErrCfgInvalidHostOverride
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+
+	if ps == "" {
+		return host, nil
+	}
+
+	if port, err = strconv.Atoi(ps); err != nil || port <= 0 || port > 65535 {
+		return "", ErrCfgInvalidHostOverride
+	}
+
+	return net.JoinHostPort(host, ps), nil
+}
+
+func (c *Config) compileHosts() error {
+	var (
+		key    string
+		target string
+		err    error
+	)
+
+	c.hostOverrides = make(map[string]string)
+	for k, v := range c.HostOverrides {
+		if key, err = normalizeHostKey(k); err != nil {
+			return err
+		}
+
+		if target, err = normalizeHostKey(v); err != nil {
+			return err
+		}
+
+		c.hostOverrides[key] = target
+	}
+
+	return nil
+}
+
+// overrideHost returns the target of dst which is "host:port", the entry of
+// "host:port" is preferred to the one of "host" and the port of dst is kept if
+// the target has no port
+func (c *Config) overrideHost(dst string) (string, bool) {
+	var (
+		host   string
+		port   string
+		key    string
+		target string
+		ok     bool
+		err    error
+	)
+
+	if c.compile() != nil || len(c.hostOverrides) == 0 {
+		return dst, false
+	}
+
+	if host, port, err = net.SplitHostPort(dst); err != nil {
+		return dst, false
+	}
+
+	if key, err = normalizeHostKey(host); err != nil {
+		return dst, false
+	}
+
+	if target, ok = c.hostOverrides[net.JoinHostPort(key, port)]; !ok {
+		if target, ok = c.hostOverrides[key]; !ok {
+			return dst, false
+		}
+	}
+
+	if _, _, err = net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, port)
+	}
+
+	return target, true
+}
+
+// overrideDst rewrites the destination by HostOverrides, the ACL, route rules and
+// resolvers see the effective destination
+func (c *conn) overrideDst() error {
+	var (
+		orig   = c.dstHost
+		target string
+		ok     bool
+	)
+
+	if target, ok = c.server.Cfg.overrideHost(orig); !ok {
+		return nil
+	}
+
+	c.dstHost = target
+	if err := c.resolveDstAddr(); err != nil {
+		return err
+	}
+
+	c.server.Log("HostOverrides: rewrite", orig, "to", target)
+	return nil
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestOverrideHost(t *testing.T) {
+	var (
+		cfg = &Config{
+			HostOverrides: map[string]string{
+				"api.example.com":     "10.0.0.1",
+				"API.example.com:443": "staging.example.com:8443",
+				"10.1.1.1:80":         "[fd00::1]:8080",
+				"0:0::2":              "localhost",
+			},
+		}
+	)
+
+	cases := map[string]string{
+		"api.example.com:80":   "10.0.0.1:80",
+		"api.example.com.:443": "staging.example.com:8443",
+		"10.1.1.1:80":          "[fd00::1]:8080",
+		"[::2]:22":             "localhost:22",
+		"10.1.1.1:81":          "10.1.1.1:81",
+		"www.example.com:443":  "www.example.com:443",
+	}
+
+	for dst, expected := range cases {
+		if target, _ := cfg.overrideHost(dst); target != expected {
+			t.Fatal("Unexpected target", dst, target, expected)
+		}
+	}
+
+	for _, v := range []map[string]string{{"a.com": ""}, {"a.com": "b.com:0"}, {"a.com:http": "b.com"}} {
+		if (&Config{HostOverrides: v}).compileHosts() != ErrCfgInvalidHostOverride {
+			t.Fatal("Expected invalid HostOverrides", v)
+		}
+	}
+}
+
+func TestOverrideConnect(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		srv  = listenServer(t, &Config{
+			HostOverrides: map[string]string{"api.example.com:443": echo.Addr().String()},
+		})
+		nc  net.Conn
+		buf = make([]byte, 10)
+		err error
+	)
+
+	defer echo.Close()
+	defer srv.Close()
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	nc.Write([]byte{version5, 1, authMethodBare})
+	if _, err = io.ReadFull(nc, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	host := "api.example.com"
+	nc.Write(append(append([]byte{version5, cmdConnect, reqRsv, aTypDomain, byte(len(host))}, host...), 443>>8, 443&0xFF))
+	if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != repSucceeded {
+		t.Fatal("Unexpected replay", buf, err)
+	}
+
+	nc.Write([]byte("hello"))
+	if _, err = io.ReadFull(nc, buf[:5]); err != nil || string(buf[:5]) != "hello" {
+		t.Fatal("Unexpected echo", buf[:5], err)
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// versionHttp is the pseudo version of HTTP proxy clients, whose first byte
+	// is an upper case letter of the request method
+	versionHttp = byte(0)
+
+	httpProxyRealm = "cola"
+)
+
+var (
+	ErrHttpReadRequest    = errors.New("Http: failed to read request.")
+	ErrHttpAuthRequired   = errors.New("Http: proxy authentication required.")
+	ErrHttpInvalidHost    = errors.New("Http: invalid host.")
+	ErrHttpWriteResponse  = errors.New("Http: failed to write response.")
+	ErrHttpUnsupportedUrl = errors.New("Http: only absolute http URLs can be forwarded.")
+	ErrHttpForwardRequest = errors.New("Http: failed to forward request.")
+	ErrHttpReadResponse   = errors.New("Http: failed to read response.")
+)
+
+// hopHeaders are removed when forwarding, see https://tools.ietf.org/html/rfc7230#section-6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func isHttpMethodByte(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// negotiateHttp reads the request of the HTTP proxy client and checks its
+// Proxy-Authorization, clients without it are accepted only if method 0 is allowed.
+// the credentials are ignored if method 2 isn't allowed
+func (c *conn) negotiateHttp() error {
+	var (
+		err error
+		un  string
+		pwd string
+		ok  bool
+	)
+
+	if c.httpReq, err = http.ReadRequest(c.br); err != nil {
+		c.writeHttpStatus(http.StatusBadRequest, nil)
+		return ErrHttpReadRequest
+	}
+
+	if un, pwd, ok = parseProxyAuth(c.httpReq.Header.Get("Proxy-Authorization")); !ok || !c.allowAuthMethod(authMethodUnPwd) {
+		if c.acceptBare() {
+			return nil
+		}
+
+		c.writeHttpStatus(http.StatusProxyAuthRequired, http.Header{
+			"Proxy-Authenticate": {fmt.Sprintf("Basic realm=%q", httpProxyRealm)},
+		})
+		return ErrHttpAuthRequired
+	}
+
+	c.method = authMethodUnPwd
+	if err = c.authenticate(un, pwd); err != nil {
+		c.writeHttpStatus(http.StatusProxyAuthRequired, http.Header{
+			"Proxy-Authenticate": {fmt.Sprintf("Basic realm=%q", httpProxyRealm)},
+		})
+		return err
+	}
+
+	return nil
+}
+
+// exchangeHttp serves the CONNECT method with the same procedures of SOCKS5 CONNECT,
+// other methods are forwarded to the origin server
+func (c *conn) exchangeHttp() error {
+	if c.httpReq.Method != http.MethodConnect {
+		return c.forwardHttp()
+	}
+
+	return c.connectHttp()
+}
+
+func (c *conn) connectHttp() error {
+	var (
+		err error
+	)
+
+	c.dstHost = c.httpReq.Host
+	if err = c.resolveDstAddr(); err != nil {
+		c.server.Log(ErrHttpInvalidHost, c.dstHost)
+		return c.writeHttpStatus(http.StatusBadRequest, nil)
+	}
+
+	if err = c.prepareExchange(); err != nil {
+		c.server.Log(err)
+		return c.writeHttpStatus(httpStatusOf(err), nil)
+	}
+
+	if _, err = c.netConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return ErrHttpWriteResponse
+	}
+
+	return c.relay()
+}
+
+// forwardHttp forwards the requests with absolute http URLs in origin form, the
+// connection to the origin server is kept alive as long as both sides allow it and
+// the following requests are for the same host
+func (c *conn) forwardHttp() error {
+	var (
+		req   = c.httpReq
+		host  string
+		dstBr *bufio.Reader
+		rep   *http.Response
+		up    io.Writer
+		down  io.Writer
+		err   error
+
+		// connHost is the requested host of c.dstConn, c.dstHost may be overridden
+		connHost string
+	)
+
+	for {
+		if req.Method == http.MethodConnect {
+			c.httpReq = req
+			c.closeDst()
+			return c.connectHttp()
+		}
+
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			c.writeHttpStatus(http.StatusBadRequest, nil)
+			return ErrHttpUnsupportedUrl
+		}
+
+		if host = req.URL.Host; req.URL.Port() == "" {
+			host = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+
+		if c.dstConn == nil || connHost != host {
+			c.closeDst()
+
+			c.dstHost, connHost = host, host
+			if err = c.resolveDstAddr(); err != nil {
+				c.server.Log(ErrHttpInvalidHost, c.dstHost)
+				return c.writeHttpStatus(http.StatusBadGateway, nil)
+			}
+
+			if err = c.prepareExchange(); err != nil {
+				c.server.Log(err)
+				return c.writeHttpStatus(httpStatusOf(err), nil)
+			}
+
+			up, down = c.relayWriters(c.dstConn, c.netConn)
+			dstBr = bufio.NewReader(c.dstConn)
+		}
+
+		removeHopHeaders(req.Header)
+		if err = req.Write(up); err != nil {
+			c.server.Log(ErrHttpForwardRequest, c.dstHost)
+			return c.writeHttpStatus(http.StatusBadGateway, nil)
+		}
+
+		if rep, err = http.ReadResponse(dstBr, req); err != nil {
+			c.server.Log(ErrHttpReadResponse, c.dstHost)
+			return c.writeHttpStatus(http.StatusBadGateway, nil)
+		}
+
+		removeHopHeaders(rep.Header)
+		err = rep.Write(down)
+		rep.Body.Close()
+
+		if err != nil {
+			return ErrHttpWriteResponse
+		}
+
+		if req.Close || rep.Close {
+			return nil
+		}
+
+		if req, err = http.ReadRequest(c.br); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return ErrHttpReadRequest
+		}
+	}
+}
+
+// writeHttpStatus writes a response without body and closes the connection
+func (c *conn) writeHttpStatus(code int, h http.Header) error {
+	var (
+		rep = &http.Response{
+			StatusCode: code,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     h,
+			Close:      true,
+		}
+		err error
+	)
+
+	if rep.Header == nil {
+		rep.Header = make(http.Header)
+	}
+
+	err = rep.Write(c.netConn)
+	c.close()
+
+	if err != nil {
+		return ErrHttpWriteResponse
+	}
+
+	return nil
+}
+
+// parseProxyAuth parses the Basic credentials of Proxy-Authorization
+func parseProxyAuth(auth string) (un string, pwd string, ok bool) {
+	var (
+		prefix = "Basic "
+		b      []byte
+		err    error
+		i      int
+	)
+
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	if b, err = base64.StdEncoding.DecodeString(auth[len(prefix):]); err != nil {
+		return "", "", false
+	}
+
+	if i = strings.IndexByte(string(b), ':'); i < 0 {
+		return "", "", false
+	}
+
+	return string(b[:i]), string(b[i+1:]), true
+}
+
+// httpStatusOf maps the error of prepareExchange to the status code
+func httpStatusOf(err error) int {
+	if err == ErrAclDenied || err == ErrGuardBlocked || err == ErrRouteRejected {
+		return http.StatusForbidden
+	}
+
+	if err == ErrQuotaSessions || err == ErrQuotaConnectRate || err == ErrTrafficQuotaExceeded {
+		return http.StatusTooManyRequests
+	}
+
+	return http.StatusBadGateway
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range strings.Split(h.Get("Connection"), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			h.Del(f)
+		}
+	}
+
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
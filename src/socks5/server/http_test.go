@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func listenHttpOrigin(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	}))
+}
+
+// httpGet sends a GET of url through the proxy connection and returns the body
+func httpGet(t *testing.T, nc net.Conn, br *bufio.Reader, url string, h http.Header) (*http.Response, string) {
+	var (
+		req *http.Request
+		rep *http.Response
+		b   []byte
+		err error
+	)
+
+	if req, err = http.NewRequest(http.MethodGet, url, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range h {
+		req.Header[k] = v
+	}
+
+	if err = req.WriteProxy(nc); err != nil {
+		t.Fatal(err)
+	}
+
+	if rep, err = http.ReadResponse(br, req); err != nil {
+		t.Fatal(err)
+	}
+
+	defer rep.Body.Close()
+	if b, err = ioutil.ReadAll(rep.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	return rep, string(b)
+}
+
+func TestHttpKeepAliveSwitchHost(t *testing.T) {
+	var (
+		a   = listenHttpOrigin("a")
+		b   = listenHttpOrigin("b")
+		srv = listenServer(t, &Config{})
+		nc  net.Conn
+		br  *bufio.Reader
+		err error
+	)
+
+	defer a.Close()
+	defer b.Close()
+	defer srv.Close()
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+	br = bufio.NewReader(nc)
+
+	for _, url := range []string{a.URL, a.URL, b.URL, a.URL} {
+		if _, body := httpGet(t, nc, br, url, nil); url == a.URL && body != "a" || url == b.URL && body != "b" {
+			t.Fatal("Unexpected response of", url, body)
+		}
+	}
+}
+
+func TestHttpConnect(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		srv  = listenServer(t, &Config{AuthMethods: []uint8{authMethodUnPwd}, UsrPwdPairs: UsrPwdPairs{"Usr1": "Pwd1"}})
+		auth = base64.StdEncoding.EncodeToString([]byte("Usr1:Pwd1"))
+		nc   net.Conn
+		br   *bufio.Reader
+		rep  *http.Response
+		buf  = make([]byte, 4)
+		err  error
+	)
+
+	defer echo.Close()
+	defer srv.Close()
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+	br = bufio.NewReader(nc)
+
+	fmt.Fprintf(nc, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\nProxy-Authorization: Basic %s\r\n\r\n", echo.Addr(), auth)
+	if rep, err = http.ReadResponse(br, nil); err != nil || rep.StatusCode != http.StatusOK {
+		t.Fatal("Expected the tunnel to be established", rep, err)
+	}
+
+	nc.Write([]byte("ping"))
+	if _, err = io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatal("Unexpected echo", string(buf), err)
+	}
+}
+
+func TestHttpAuthRequired(t *testing.T) {
+	var (
+		srv = listenServer(t, &Config{AuthMethods: []uint8{authMethodUnPwd}, UsrPwdPairs: UsrPwdPairs{"Usr1": "Pwd1"}})
+		nc  net.Conn
+		rep *http.Response
+		err error
+	)
+
+	defer srv.Close()
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	fmt.Fprint(nc, "CONNECT 127.0.0.1:80 HTTP/1.1\r\nHost: 127.0.0.1:80\r\n\r\n")
+	if rep, err = http.ReadResponse(bufio.NewReader(nc), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if rep.StatusCode != http.StatusProxyAuthRequired || rep.Header.Get("Proxy-Authenticate") == "" {
+		t.Fatal("Expected the credentials to be required", rep)
+	}
+}
+
+func TestHttpForward(t *testing.T) {
+	var (
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, k := range []string{"Proxy-Authorization", "Proxy-Connection", "X-Hop"} {
+				if r.Header.Get(k) != "" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+
+			w.Header().Set("Connection", "X-Hop")
+			w.Header().Set("X-Hop", "1")
+			fmt.Fprint(w, r.Header.Get("X-End"))
+		}))
+		srv = listenServer(t, &Config{AuthMethods: []uint8{authMethodUnPwd}, UsrPwdPairs: UsrPwdPairs{"Usr1": "Pwd1"}})
+		nc  net.Conn
+		err error
+	)
+
+	defer origin.Close()
+	defer srv.Close()
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	rep, body := httpGet(t, nc, bufio.NewReader(nc), origin.URL, http.Header{
+		"Proxy-Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("Usr1:Pwd1"))},
+		"Proxy-Connection":    {"keep-alive"},
+		"Connection":          {"X-Hop"},
+		"X-Hop":               {"1"},
+		"X-End":               {"end"},
+	})
+
+	if rep.StatusCode != http.StatusOK || body != "end" {
+		t.Fatal("Expected the hop-by-hop headers to be removed from the request", rep.Status, body)
+	}
+
+	if rep.Header.Get("X-Hop") != "" {
+		t.Fatal("Expected the hop-by-hop headers to be removed from the response", rep.Header)
+	}
+}
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	pwdKindPlain       = "plain"
+	pwdKindBcrypt      = "bcrypt"
+	pwdKindArgon2id    = "argon2id"
+	pwdKindSha256Crypt = "sha256-crypt"
+	pwdKindSha512Crypt = "sha512-crypt"
+
+	shaCryptRoundsPrefix  = "rounds="
+	shaCryptRoundsDefault = 5000
+	shaCryptRoundsMin     = 1000
+	shaCryptRoundsMax     = 999999999
+	shaCryptSaltMaxLen    = 16
+	shaCryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	// pwdDummyHash is verified for unknown users so they take as long as the known
+	// ones, it's the bcrypt hash of a random password with the default cost
+	pwdDummyHash = "$2a$10$s1a1Pf8zYXeFsVKOz5BKVO0vyqkDdnLKUJ6A9.Pd0/K8KCj5rHC52"
+)
+
+var (
+	ErrPwdUnsupportedHash = errors.New("Password: unsupported hash, only bcrypt, argon2id and SHA-crypt are supported.")
+	ErrPwdInvalidHash     = errors.New("Password: invalid hash.")
+)
+
+// the order of bytes of the final digest when they are encoded by SHA-crypt,
+// each group is encoded into 4 chars except the last one
+var (
+	sha256CryptPerm = [][]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+		{-1, 31, 30},
+	}
+
+	sha512CryptPerm = [][]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41}, {-1, -1, 63},
+	}
+)
+
+// pwdKind returns the kind of a stored password by its prefix, a password not
+// starting with "$" is treated as plaintext
+func pwdKind(stored string) (string, error) {
+	switch {
+	case !strings.HasPrefix(stored, "$"):
+		return pwdKindPlain, nil
+	case strings.HasPrefix(stored, "$2a$"),
+		strings.HasPrefix(stored, "$2b$"),
+		strings.HasPrefix(stored, "$2y$"):
+		return pwdKindBcrypt, nil
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return pwdKindArgon2id, nil
+	case strings.HasPrefix(stored, "$5$"):
+		return pwdKindSha256Crypt, nil
+	case strings.HasPrefix(stored, "$6$"):
+		return pwdKindSha512Crypt, nil
+	default:
+		return "", ErrPwdUnsupportedHash
+	}
+}
+
+// checkPwdHash validates the format of a stored password
+func checkPwdHash(stored string) error {
+	var (
+		kind string
+		err  error
+	)
+
+	if kind, err = pwdKind(stored); err != nil {
+		return err
+	}
+
+	switch kind {
+	case pwdKindBcrypt:
+		if _, err = bcrypt.Cost([]byte(stored)); err != nil {
+			return ErrPwdInvalidHash
+		}
+	case pwdKindArgon2id:
+		if _, _, _, _, _, err = parseArgon2id(stored); err != nil {
+			return err
+		}
+	case pwdKindSha256Crypt, pwdKindSha512Crypt:
+		if _, _, _, err = parseShaCrypt(stored); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyPwd reports whether pwd matches the stored password, all the
+// comparisons are in constant time
+func verifyPwd(stored string, pwd string) bool {
+	var (
+		kind string
+		err  error
+	)
+
+	if kind, err = pwdKind(stored); err != nil {
+		return false
+	}
+
+	switch kind {
+	case pwdKindPlain:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(pwd)) == 1
+	case pwdKindBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(pwd)) == nil
+	case pwdKindArgon2id:
+		return verifyArgon2id(stored, pwd)
+	default:
+		return verifyShaCrypt(stored, pwd)
+	}
+}
+
+// parseArgon2id parses the PHC string format: $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+func parseArgon2id(stored string) (memory uint32, time uint32, threads uint8, salt []byte, key []byte, err error) {
+	var (
+		parts   = strings.Split(stored, "$")
+		version int
+	)
+
+	if len(parts) != 6 {
+		return 0, 0, 0, nil, nil, ErrPwdInvalidHash
+	}
+
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return 0, 0, 0, nil, nil, ErrPwdInvalidHash
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return 0, 0, 0, nil, nil, ErrPwdInvalidHash
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return 0, 0, 0, nil, nil, ErrPwdInvalidHash
+	}
+
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return 0, 0, 0, nil, nil, ErrPwdInvalidHash
+	}
+
+	return memory, time, threads, salt, key, nil
+}
+
+func verifyArgon2id(stored string, pwd string) bool {
+	memory, time, threads, salt, key, err := parseArgon2id(stored)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, argon2.IDKey([]byte(pwd), salt, time, memory, threads, uint32(len(key)))) == 1
+}
+
+// parseShaCrypt parses $5$[rounds=N$]salt$hash and $6$[rounds=N$]salt$hash,
+// see https://www.akkadia.org/drepper/SHA-crypt.txt
+func parseShaCrypt(stored string) (rounds int, roundsSet bool, salt string, err error) {
+	var (
+		parts = strings.Split(stored[3:], "$")
+	)
+
+	rounds = shaCryptRoundsDefault
+	if len(parts) == 3 && strings.HasPrefix(parts[0], shaCryptRoundsPrefix) {
+		if rounds, err = strconv.Atoi(parts[0][len(shaCryptRoundsPrefix):]); err != nil {
+			return 0, false, "", ErrPwdInvalidHash
+		}
+
+		if rounds < shaCryptRoundsMin {
+			rounds = shaCryptRoundsMin
+		} else if rounds > shaCryptRoundsMax {
+			rounds = shaCryptRoundsMax
+		}
+
+		roundsSet = true
+		parts = parts[1:]
+	}
+
+	if len(parts) != 2 || len(parts[0]) > shaCryptSaltMaxLen {
+		return 0, false, "", ErrPwdInvalidHash
+	}
+
+	return rounds, roundsSet, parts[0], nil
+}
+
+func verifyShaCrypt(stored string, pwd string) bool {
+	var (
+		rounds    int
+		roundsSet bool
+		salt      string
+		err       error
+	)
+
+	if rounds, roundsSet, salt, err = parseShaCrypt(stored); err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(shaCrypt(stored[:3], pwd, salt, rounds, roundsSet))) == 1
+}
+
+// shaCrypt computes the SHA-crypt string, prefix is "$5$" or "$6$"
+func shaCrypt(prefix string, pwd string, salt string, rounds int, roundsSet bool) string {
+	var (
+		newHash func() hash.Hash
+		perm    [][]int
+		key     = []byte(pwd)
+		s       = []byte(salt)
+		h       hash.Hash
+		a       []byte
+		b       []byte
+		dp      []byte
+		ds      []byte
+		p       []byte
+		ss      []byte
+		out     strings.Builder
+	)
+
+	if prefix == "$5$" {
+		newHash, perm = sha256.New, sha256CryptPerm
+	} else {
+		newHash, perm = sha512.New, sha512CryptPerm
+	}
+
+	h = newHash()
+	h.Write(key)
+	h.Write(s)
+	h.Write(key)
+	b = h.Sum(nil)
+
+	h = newHash()
+	h.Write(key)
+	h.Write(s)
+	h.Write(repeatBytes(b, len(key)))
+	for i := len(key); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(key)
+		}
+	}
+	a = h.Sum(nil)
+
+	h = newHash()
+	for i := 0; i < len(key); i++ {
+		h.Write(key)
+	}
+	dp = h.Sum(nil)
+	p = repeatBytes(dp, len(key))
+
+	h = newHash()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(s)
+	}
+	ds = h.Sum(nil)
+	ss = repeatBytes(ds, len(s))
+
+	for i := 0; i < rounds; i++ {
+		h = newHash()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(a)
+		}
+
+		if i%3 != 0 {
+			h.Write(ss)
+		}
+
+		if i%7 != 0 {
+			h.Write(p)
+		}
+
+		if i&1 != 0 {
+			h.Write(a)
+		} else {
+			h.Write(p)
+		}
+
+		a = h.Sum(nil)
+	}
+
+	out.WriteString(prefix)
+	if roundsSet {
+		out.WriteString(shaCryptRoundsPrefix + strconv.Itoa(rounds) + "$")
+	}
+
+	out.WriteString(salt)
+	out.WriteString("$")
+
+	for _, g := range perm {
+		var (
+			w uint
+			n = 4
+		)
+
+		for _, i := range g {
+			w <<= 8
+			if i >= 0 {
+				w |= uint(a[i])
+			}
+		}
+
+		switch {
+		case g[0] == -1 && g[1] == -1:
+			n = 2
+		case g[0] == -1:
+			n = 3
+		}
+
+		for ; n > 0; n-- {
+			out.WriteByte(shaCryptAlphabet[w&0x3F])
+			w >>= 6
+		}
+	}
+
+	return out.String()
+}
+
+// repeatBytes repeats b until it's n bytes long
+func repeatBytes(b []byte, n int) []byte {
+	var (
+		r = make([]byte, 0, n)
+	)
+
+	for len(r)+len(b) <= n {
+		r = append(r, b...)
+	}
+
+	return append(r, b[:n-len(r)]...)
+}
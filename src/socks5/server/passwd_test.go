@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPwd(t *testing.T) {
+	var (
+		bc, _ = bcrypt.GenerateFromPassword([]byte("Pwd1"), bcrypt.MinCost)
+		salt  = []byte("somesaltsomesalt")
+		a2    = fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("Pwd1"), salt, 1, 64, 1, 32)))
+		cases = []struct {
+			stored string
+			pwd    string
+		}{
+			{"Pwd1", "Pwd1"},
+			{string(bc), "Pwd1"},
+			{a2, "Pwd1"},
+			// vectors of https://www.akkadia.org/drepper/SHA-crypt.txt
+			{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+			{"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+			{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+			{"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0", "This is just a test"},
+		}
+	)
+
+	for _, c := range cases {
+		if err := checkPwdHash(c.stored); err != nil {
+			t.Fatal(c.stored, err)
+		}
+
+		if !verifyPwd(c.stored, c.pwd) {
+			t.Fatal("Failed to verify", c.stored)
+		}
+
+		if verifyPwd(c.stored, c.pwd+"x") {
+			t.Fatal("Wrong password was accepted", c.stored)
+		}
+	}
+
+	if checkPwdHash("$1$salt$hash") != ErrPwdUnsupportedHash {
+		t.Fatal("Expected unsupported hash")
+	}
+}
+
+func TestAuthenticateUnknownUser(t *testing.T) {
+	var (
+		ps = UsrPwdPairs{"Usr1": "Pwd1"}
+	)
+
+	// the dummy hash should be a real bcrypt hash so it costs as much as one
+	if kind, err := pwdKind(pwdDummyHash); err != nil || kind != pwdKindBcrypt || checkPwdHash(pwdDummyHash) != nil {
+		t.Fatal("Expected the dummy hash to be bcrypt", kind, err)
+	}
+
+	if _, err := ps.Authenticate("Usr2", "Pwd1", nil); err != ErrAuthUnPwdInvalidUnOrPwd {
+		t.Fatal("Expected the unknown user to be refused", err)
+	}
+
+	if id, err := ps.Authenticate("Usr1", "Pwd1", nil); err != nil || id.Name != "Usr1" {
+		t.Fatal("Expected the user to be accepted", id, err)
+	}
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	poolStrategyRoundRobin = "round-robin"
+	poolStrategyLeastConn  = "least-conn"
+	poolStrategyLatency    = "latency"
+)
+
+var (
+	ErrPoolInvalidStrategy = errors.New("Pool: Strategy should be one of \"\", \"round-robin\", \"least-conn\" and \"latency\".")
+	ErrPoolEmpty           = errors.New("Pool: a pool should have at least one member.")
+	ErrPoolUnknownMember   = errors.New("Pool: member is not in Upstreams.")
+	ErrPoolDuplicateName   = errors.New("Pool: name is used by both Upstreams and UpstreamPools.")
+	ErrPoolProbeTimeout    = errors.New("Pool: health probe timed out.")
+	ErrPoolNoMember        = errors.New("Pool: all members failed to dial.")
+)
+
+// UpstreamPool is a group of the chains in Upstreams, a destination is dialed
+// by the member chosen by Strategy, "round-robin" by default, "least-conn" or
+// "latency". if the dial fails, the next healthy member is tried
+//
+// each member is probed every HealthCheckInterval seconds, 30 by default, by
+// connecting to HealthCheckAddr through it or to its first hop if it's empty.
+// a member is unhealthy if the probe fails or takes more than HealthCheckTimeout
+// seconds, 5 by default, and it's healthy again once a probe succeeds
+type UpstreamPool struct {
+	Members             []string `json:"Members"`
+	Strategy            string   `json:"Strategy"`
+	HealthCheckAddr     string   `json:"HealthCheckAddr"`
+	HealthCheckInterval uint     `json:"HealthCheckInterval"`
+	HealthCheckTimeout  uint     `json:"HealthCheckTimeout"`
+}
+
+func (p *UpstreamPool) healthCheckInterval() time.Duration {
+	if p.HealthCheckInterval == 0 {
+		return 30 * time.Second
+	}
+
+	return time.Duration(p.HealthCheckInterval) * time.Second
+}
+
+func (p *UpstreamPool) healthCheckTimeout() time.Duration {
+	if p.HealthCheckTimeout == 0 {
+		return 5 * time.Second
+	}
+
+	return time.Duration(p.HealthCheckTimeout) * time.Second
+}
+
+func (c *Config) checkPools() error {
+	for name, p := range c.UpstreamPools {
+		if _, ok := c.Upstreams[name]; ok {
+			return ErrPoolDuplicateName
+		}
+
+		switch p.Strategy {
+		case "", poolStrategyRoundRobin, poolStrategyLeastConn, poolStrategyLatency:
+		default:
+			return ErrPoolInvalidStrategy
+		}
+
+		if len(p.Members) == 0 {
+			return ErrPoolEmpty
+		}
+
+		for _, m := range p.Members {
+			if _, ok := c.Upstreams[m]; !ok {
+				return ErrPoolUnknownMember
+			}
+		}
+
+		if p.HealthCheckAddr != "" {
+			if _, _, err := splitHostPort(p.HealthCheckAddr); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasUpstream reports whether name is a chain of Upstreams or a pool of UpstreamPools
+func (c *Config) hasUpstream(name string) bool {
+	if _, ok := c.Upstreams[name]; ok {
+		return true
+	}
+
+	_, ok := c.UpstreamPools[name]
+	return ok
+}
+
+type poolMember struct {
+	name    string
+	d       Dialer
+	probe   string
+	healthy bool
+	conns   int
+	latency time.Duration
+}
+
+// upstreamPool is the Dialer of an UpstreamPool, it keeps the state of members
+type upstreamPool struct {
+	cfg     *UpstreamPool
+	log     func(args ...interface{})
+	mu      sync.Mutex
+	members []*poolMember
+	next    int
+}
+
+func newUpstreamPool(cfg *Config, p *UpstreamPool, log func(args ...interface{})) *upstreamPool {
+	var (
+		pool = &upstreamPool{cfg: p, log: log}
+	)
+
+	for _, name := range p.Members {
+		pool.members = append(pool.members, &poolMember{
+			name:    name,
+			d:       newChainDialer(cfg.Upstreams[name]),
+			probe:   cfg.Upstreams[name][0].Addr,
+			healthy: true,
+		})
+	}
+
+	return pool
+}
+
+// candidates returns the healthy members in the order of the strategy, all
+// members are returned if none of them is healthy since the probes may be stale
+func (p *upstreamPool) candidates() []*poolMember {
+	var (
+		ms []*poolMember
+	)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, m := range p.members {
+		if m.healthy {
+			ms = append(ms, m)
+		}
+	}
+
+	if len(ms) == 0 {
+		ms = append(ms, p.members...)
+	}
+
+	// rotate the members so the ties of the strategies are broken in turn
+	p.next++
+	ms = append(ms[p.next%len(ms):], ms[:p.next%len(ms)]...)
+
+	switch p.cfg.Strategy {
+	case poolStrategyLeastConn:
+		sort.SliceStable(ms, func(i, j int) bool { return ms[i].conns < ms[j].conns })
+	case poolStrategyLatency:
+		sort.SliceStable(ms, func(i, j int) bool { return ms[i].latency < ms[j].latency })
+	}
+
+	return ms
+}
+
+// Dial tries the candidates in order until one of them succeeds, a member is
+// marked unhealthy once it fails to dial or handshake. the member is fine if only
+// the destination is refused by it, which is returned without trying the others.
+// the destination is checked first so an invalid one isn't blamed on the members
+func (p *upstreamPool) Dial(addr string) (net.Conn, error) {
+	var (
+		nc  net.Conn
+		err error
+	)
+
+	if _, _, err = splitDstAddr(addr); err != nil {
+		return nil, err
+	}
+
+	for _, m := range p.candidates() {
+		if nc, err = m.d.Dial(addr); err == ErrUpstreamConnectFailed || err == ErrUpstreamInvalidAddr {
+			return nil, err
+		}
+
+		if err != nil {
+			p.log(err, "member:", m.name)
+			p.setHealth(m, false, 0)
+			continue
+		}
+
+		p.mu.Lock()
+		m.conns++
+		p.mu.Unlock()
+
+		return &poolConn{Conn: nc, pool: p, member: m}, nil
+	}
+
+	return nil, ErrPoolNoMember
+}
+
+func (p *upstreamPool) setHealth(m *poolMember, healthy bool, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if m.healthy != healthy {
+		p.log("Pool: member", m.name, "is healthy:", healthy)
+	}
+
+	m.healthy = healthy
+	if healthy {
+		m.latency = latency
+	}
+}
+
+// probe checks a member by connecting to HealthCheckAddr through it, or to its
+// first hop if HealthCheckAddr is empty
+func (p *upstreamPool) probe(m *poolMember) {
+	var (
+		start = time.Now()
+		done  = make(chan error, 1)
+		err   error
+	)
+
+	go func() {
+		var (
+			nc  net.Conn
+			err error
+		)
+
+		if p.cfg.HealthCheckAddr != "" {
+			nc, err = m.d.Dial(p.cfg.HealthCheckAddr)
+		} else {
+			nc, err = net.DialTimeout("tcp", m.probe, p.cfg.healthCheckTimeout())
+		}
+
+		if err == nil {
+			nc.Close()
+		}
+
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(p.cfg.healthCheckTimeout()):
+		err = ErrPoolProbeTimeout
+	}
+
+	p.setHealth(m, err == nil, time.Since(start))
+}
+
+// probeLoop probes all members at once every interval, it never stops since
+// the pools live as long as the server
+func (p *upstreamPool) probeLoop() {
+	var (
+		wg sync.WaitGroup
+	)
+
+	for {
+		for _, m := range p.members {
+			wg.Add(1)
+			go func(m *poolMember) {
+				p.probe(m)
+				wg.Done()
+			}(m)
+		}
+
+		wg.Wait()
+		time.Sleep(p.cfg.healthCheckInterval())
+	}
+}
+
+// poolConn gives back the connection count of the member once closed
+type poolConn struct {
+	net.Conn
+	pool   *upstreamPool
+	member *poolMember
+	once   sync.Once
+}
+
+func (pc *poolConn) Close() error {
+	pc.once.Do(func() {
+		pc.pool.mu.Lock()
+		pc.member.conns--
+		pc.pool.mu.Unlock()
+	})
+
+	return pc.Conn.Close()
+}
+
+// upstream returns the dialer of the named chain or pool, nil means to connect
+// directly. the pools are created and start to be probed on first use
+func (s *Server) upstream(name string) Dialer {
+	var (
+		cfg  = s.Cfg
+		p    *UpstreamPool
+		pool *upstreamPool
+		ok   bool
+	)
+
+	if p, ok = cfg.UpstreamPools[name]; !ok {
+		return cfg.upstream(name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pool, ok = s.pools[name]; ok {
+		return pool
+	}
+
+	if s.pools == nil {
+		s.pools = make(map[string]*upstreamPool)
+	}
+
+	pool = newUpstreamPool(cfg, p, s.Log)
+	s.pools[name] = pool
+	go pool.probeLoop()
+
+	return pool
+}
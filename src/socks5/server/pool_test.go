@@ -0,0 +1,189 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolFailover(t *testing.T) {
+	var (
+		echo  = listenEcho(t)
+		socks = listenServer(t, &Config{})
+		dead  net.Listener
+		cfg   *Config
+		pool  *upstreamPool
+		nc    net.Conn
+		err   error
+	)
+
+	defer echo.Close()
+	defer socks.Close()
+
+	// a port which refuses connections
+	if dead, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	dead.Close()
+
+	cfg = &Config{
+		Upstreams: map[string][]*UpstreamHop{
+			"dead": {{Type: upstreamTypeSocks5, Addr: dead.Addr().String()}},
+			"live": {{Type: upstreamTypeSocks5, Addr: socks.Addr().String()}},
+		},
+		UpstreamPools: map[string]*UpstreamPool{
+			"pool": {Members: []string{"dead", "live"}, Strategy: poolStrategyRoundRobin},
+		},
+	}
+
+	if err = cfg.checkUpstreams(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool = newUpstreamPool(cfg, cfg.UpstreamPools["pool"], t.Log)
+	for i := 0; i < 2; i++ {
+		if nc, err = pool.Dial(echo.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+
+		nc.Close()
+	}
+
+	if pool.members[0].healthy || !pool.members[1].healthy {
+		t.Fatal("Expected the dead member to be unhealthy")
+	}
+
+	pool.probe(pool.members[0])
+	pool.probe(pool.members[1])
+	if pool.members[0].healthy || !pool.members[1].healthy || pool.members[1].conns != 0 {
+		t.Fatal("Unexpected result of probes")
+	}
+}
+
+func TestPoolStrategies(t *testing.T) {
+	var (
+		pool = &upstreamPool{
+			cfg: &UpstreamPool{Strategy: poolStrategyLeastConn},
+			members: []*poolMember{
+				{name: "a", healthy: true, conns: 3, latency: time.Millisecond},
+				{name: "b", healthy: true, conns: 1, latency: 3 * time.Millisecond},
+				{name: "c", healthy: false, conns: 0, latency: 2 * time.Millisecond},
+			},
+		}
+		ms []*poolMember
+	)
+
+	if ms = pool.candidates(); len(ms) != 2 || ms[0].name != "b" {
+		t.Fatal("Unexpected least-conn order", ms[0].name)
+	}
+
+	pool.cfg.Strategy = poolStrategyLatency
+	if ms = pool.candidates(); ms[0].name != "a" {
+		t.Fatal("Unexpected latency order", ms[0].name)
+	}
+
+	pool.cfg.Strategy = poolStrategyRoundRobin
+	if a, b := pool.candidates()[0].name, pool.candidates()[0].name; a == b {
+		t.Fatal("Expected round-robin to rotate", a, b)
+	}
+}
+
+func TestPoolCheck(t *testing.T) {
+	var (
+		ups   = map[string][]*UpstreamHop{"a": {{Type: upstreamTypeSocks5, Addr: "10.0.0.1:1080"}}}
+		cases = map[*Config]error{
+			{Upstreams: ups, UpstreamPools: map[string]*UpstreamPool{"a": {Members: []string{"a"}}}}:                       ErrPoolDuplicateName,
+			{Upstreams: ups, UpstreamPools: map[string]*UpstreamPool{"p": {}}}:                                             ErrPoolEmpty,
+			{Upstreams: ups, UpstreamPools: map[string]*UpstreamPool{"p": {Members: []string{"b"}}}}:                       ErrPoolUnknownMember,
+			{Upstreams: ups, UpstreamPools: map[string]*UpstreamPool{"p": {Members: []string{"a"}, Strategy: "random"}}}:   ErrPoolInvalidStrategy,
+			{Upstreams: ups, UpstreamPools: map[string]*UpstreamPool{"p": {Members: []string{"a"}}}, DefaultUpstream: "p"}: nil,
+		}
+	)
+
+	for cfg, expected := range cases {
+		if err := cfg.checkUpstreams(); err != expected {
+			t.Fatal("Unexpected result", err, expected)
+		}
+	}
+}
+
+func TestPoolDeadDestination(t *testing.T) {
+	var (
+		a    = listenServer(t, &Config{})
+		b    = listenServer(t, &Config{})
+		dead net.Listener
+		cfg  *Config
+		pool *upstreamPool
+		err  error
+	)
+
+	defer a.Close()
+	defer b.Close()
+
+	if dead, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	dead.Close()
+
+	cfg = &Config{
+		Upstreams: map[string][]*UpstreamHop{
+			"a": {{Type: upstreamTypeSocks5, Addr: a.Addr().String()}},
+			"b": {{Type: upstreamTypeHttp, Addr: b.Addr().String()}},
+			// the first hop is alive but the second one isn't
+			"chain": {
+				{Type: upstreamTypeSocks5, Addr: a.Addr().String()},
+				{Type: upstreamTypeSocks5, Addr: dead.Addr().String()},
+			},
+		},
+		UpstreamPools: map[string]*UpstreamPool{
+			"pool":  {Members: []string{"a", "b"}},
+			"relay": {Members: []string{"chain", "a"}},
+		},
+	}
+
+	if err = cfg.checkUpstreams(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool = newUpstreamPool(cfg, cfg.UpstreamPools["pool"], t.Log)
+	for i := 0; i < 2; i++ {
+		if _, err = pool.Dial(dead.Addr().String()); err != ErrUpstreamConnectFailed {
+			t.Fatal("Expected the destination to be refused", err)
+		}
+	}
+
+	if !pool.members[0].healthy || !pool.members[1].healthy {
+		t.Fatal("Expected the members to stay healthy")
+	}
+
+	for _, addr := range []string{"127.0.0.1:0", "127.0.0.1", strings.Repeat("a", 256) + ":80"} {
+		if _, err = pool.Dial(addr); err != ErrUpstreamInvalidAddr {
+			t.Fatal("Expected the destination to be invalid", addr, err)
+		}
+	}
+
+	if !pool.members[0].healthy || !pool.members[1].healthy {
+		t.Fatal("Expected the members to stay healthy after invalid destinations")
+	}
+
+	pool = newUpstreamPool(cfg, cfg.UpstreamPools["relay"], t.Log)
+	if _, err = pool.members[0].d.Dial(b.Addr().String()); err != ErrUpstreamHopFailed {
+		t.Fatal("Expected the failure of the hop", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		nc, err := pool.Dial(b.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nc.Close()
+	}
+
+	if pool.members[0].healthy || !pool.members[1].healthy {
+		t.Fatal("Expected the member with the dead hop to be unhealthy")
+	}
+}
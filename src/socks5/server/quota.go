@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrQuotaSessions    = errors.New("Quota: too many concurrent sessions.")
+	ErrQuotaConnectRate = errors.New("Quota: too many new connections per second.")
+)
+
+// Quota limits the sessions of a user, 0 means unlimited. MaxSessions is the
+// number of concurrent sessions and MaxConnectRate is the number of new CONNECTs
+// per second
+type Quota struct {
+	MaxSessions    uint `json:"MaxSessions"`
+	MaxConnectRate uint `json:"MaxConnectRate"`
+}
+
+// userQuota is the usage of a user, connects are counted in one second windows
+type userQuota struct {
+	sessions uint
+	connects uint
+	window   time.Time
+}
+
+// quota returns the quota of the user, UserQuotas overrides Quota
+func (c *Config) quota(user string) *Quota {
+	if q, ok := c.UserQuotas[user]; ok {
+		return q
+	}
+
+	return c.Quota
+}
+
+// acquireQuota takes a session of the user if session is true, and a new
+// connection if connect is true. it reports whether a session was taken
+func (s *Server) acquireQuota(user string, session bool, connect bool) (bool, error) {
+	var (
+		q   = s.Cfg.quota(user)
+		uq  *userQuota
+		now = time.Now()
+		ok  bool
+	)
+
+	if q == nil || (q.MaxSessions == 0 && q.MaxConnectRate == 0) {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.quotas == nil {
+		s.quotas = make(map[string]*userQuota)
+	}
+
+	if uq, ok = s.quotas[user]; !ok {
+		uq = &userQuota{}
+		s.quotas[user] = uq
+	}
+
+	if session && q.MaxSessions > 0 && uq.sessions >= q.MaxSessions {
+		return false, ErrQuotaSessions
+	}
+
+	if connect && q.MaxConnectRate > 0 {
+		if now.Sub(uq.window) >= time.Second {
+			uq.window, uq.connects = now, 0
+		}
+
+		if uq.connects >= q.MaxConnectRate {
+			return false, ErrQuotaConnectRate
+		}
+
+		uq.connects++
+	}
+
+	if session {
+		uq.sessions++
+	}
+
+	return session, nil
+}
+
+func (s *Server) releaseQuota(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if uq, ok := s.quotas[user]; ok && uq.sessions > 0 {
+		uq.sessions--
+	}
+}
+
+// checkQuota counts the session of the conn once and a new connection if
+// connect is true, a new session is also refused if the traffic quota is used
+// up. the refusal is logged with the username
+func (c *conn) checkQuota(connect bool) error {
+	var (
+		name = c.userName()
+		held bool
+		err  error
+	)
+
+	if !c.quotaHeld {
+		if err = c.server.checkTrafficQuota(name); err != nil {
+			c.server.Log(err, "user:", name)
+			return err
+		}
+	}
+
+	if held, err = c.server.acquireQuota(name, !c.quotaHeld, connect); err != nil {
+		c.server.Log(err, "user:", name)
+		return err
+	}
+
+	if held {
+		c.quotaHeld, c.quotaUser = true, name
+	}
+
+	return nil
+}
+
+// releaseQuota gives back the session held by the conn
+func (c *conn) releaseQuota() {
+	if c.quotaHeld {
+		c.server.releaseQuota(c.quotaUser)
+		c.quotaHeld = false
+	}
+}
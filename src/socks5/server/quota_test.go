@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logBuffer collects the log of the server
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// connectUnPwd sends CONNECT of the local port as the user and returns the reply code
+func connectUnPwd(t *testing.T, srv net.Listener, un string, pwd string, port int) (net.Conn, byte) {
+	var (
+		nc  net.Conn
+		buf = make([]byte, 10)
+		err error
+	)
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	nc.Write([]byte{version5, 1, authMethodUnPwd})
+	if _, err = io.ReadFull(nc, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	nc.Write(append(append([]byte{1, byte(len(un))}, un...), append([]byte{byte(len(pwd))}, pwd...)...))
+	if _, err = io.ReadFull(nc, buf[:2]); err != nil || buf[1] != authMethodUnPwdStatusSucceed {
+		t.Fatal("Unexpected auth status", buf[:2], err)
+	}
+
+	nc.Write([]byte{version5, cmdConnect, reqRsv, aTypIpv4, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	if _, err = io.ReadFull(nc, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return nc, buf[1]
+}
+
+func TestAcquireQuota(t *testing.T) {
+	var (
+		s = &Server{Cfg: &Config{
+			Quota:      &Quota{MaxSessions: 2, MaxConnectRate: 3},
+			UserQuotas: map[string]*Quota{"bob": {}},
+		}}
+		held bool
+		err  error
+	)
+
+	for i := 0; i < 2; i++ {
+		if held, err = s.acquireQuota("alice", true, true); err != nil || !held {
+			t.Fatal("Unexpected result of session", i, held, err)
+		}
+	}
+
+	if _, err = s.acquireQuota("alice", true, false); err != ErrQuotaSessions {
+		t.Fatal("Expected too many sessions", err)
+	}
+
+	s.releaseQuota("alice")
+	if _, err = s.acquireQuota("alice", true, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.acquireQuota("alice", false, true); err != ErrQuotaConnectRate {
+		t.Fatal("Expected too many connects", err)
+	}
+
+	if held, err = s.acquireQuota("bob", true, true); err != nil || held {
+		t.Fatal("Expected bob to be unlimited", held, err)
+	}
+}
+
+func TestQuotaRefused(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		port = echo.Addr().(*net.TCPAddr).Port
+		srv  = listenServer(t, &Config{
+			AuthMethods: []uint8{authMethodUnPwd},
+			UsrPwdPairs: UsrPwdPairs{"Usr1": "Pwd1", "Usr2": "Pwd2"},
+			UserQuotas:  map[string]*Quota{"Usr1": {MaxSessions: 1}, "Usr2": {MaxConnectRate: 1}},
+		})
+		logs = &logBuffer{}
+		nc   net.Conn
+		rep  byte
+	)
+
+	defer echo.Close()
+	defer srv.Close()
+
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	cases := []struct {
+		un   string
+		pwd  string
+		want error
+	}{
+		{"Usr1", "Pwd1", ErrQuotaSessions},
+		{"Usr2", "Pwd2", ErrQuotaConnectRate},
+	}
+
+	for _, c := range cases {
+		if nc, rep = connectUnPwd(t, srv, c.un, c.pwd, port); rep != repSucceeded {
+			t.Fatal("Expected the first session of", c.un, "to succeed", rep)
+		}
+
+		defer nc.Close()
+
+		if nc, rep = connectUnPwd(t, srv, c.un, c.pwd, port); rep != repNotAllowed {
+			t.Fatal("Expected the second session of", c.un, "to be refused", rep)
+		}
+
+		nc.Close()
+
+		if !strings.Contains(logs.String(), c.want.Error()+" user: "+c.un) {
+			t.Fatal("Expected the refusal to be logged with the username", logs.String())
+		}
+	}
+}
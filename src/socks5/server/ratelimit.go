@@ -0,0 +1,241 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// anonLimitersPrune is the number of the limiters of anonymous clients which
+	// triggers dropping the idle ones
+	anonLimitersPrune = 1024
+)
+
+var (
+	ErrRateLimitInvalid = errors.New("Config: rate limits and bursts should not be negative.")
+)
+
+// RateLimit is the bandwidth limit in bytes per second, 0 means unlimited.
+// the burst is one second of the rate if it's 0
+type RateLimit struct {
+	Up        int64 `json:"Up"`
+	Down      int64 `json:"Down"`
+	UpBurst   int64 `json:"UpBurst"`
+	DownBurst int64 `json:"DownBurst"`
+}
+
+func (rl *RateLimit) check() error {
+	if rl.Up < 0 || rl.Down < 0 || rl.UpBurst < 0 || rl.DownBurst < 0 {
+		return ErrRateLimitInvalid
+	}
+
+	return nil
+}
+
+// tokenBucket allows rate bytes per second with bursts of at most burst bytes,
+// the tokens can go negative so the waiters are served in the order they came
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64, burst int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = rate
+	}
+
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// full reports whether the bucket has been refilled, a full bucket is the same as a new one
+func (b *tokenBucket) full(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// wait takes n tokens and blocks until they are available, n should not be
+// greater than the burst
+func (b *tokenBucket) wait(n int) {
+	var (
+		now = time.Now()
+		d   time.Duration
+	)
+
+	b.mu.Lock()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// limitWriter writes to w no faster than the bucket allows
+type limitWriter struct {
+	w io.Writer
+	b *tokenBucket
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	var (
+		written int
+		chunk   int
+		n       int
+		err     error
+	)
+
+	for len(p) > 0 {
+		if chunk = len(p); float64(chunk) > lw.b.burst {
+			chunk = int(lw.b.burst)
+		}
+
+		lw.b.wait(chunk)
+		n, err = lw.w.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[chunk:]
+	}
+
+	return written, nil
+}
+
+// newLimitWriter wraps w if the bucket isn't nil
+func newLimitWriter(w io.Writer, b *tokenBucket) io.Writer {
+	if b == nil {
+		return w
+	}
+
+	return &limitWriter{w, b}
+}
+
+// userLimiter holds the buckets of a user, it's shared by all the sessions of the user
+type userLimiter struct {
+	up   *tokenBucket
+	down *tokenBucket
+}
+
+// rateLimit returns the limit of the user, UserRateLimits overrides RateLimit
+func (c *Config) rateLimit(user string) *RateLimit {
+	if rl, ok := c.UserRateLimits[user]; ok {
+		return rl
+	}
+
+	return c.RateLimit
+}
+
+// limiter returns the limiter of the user, nil if the user is unlimited
+func (s *Server) limiter(user string) *userLimiter {
+	return s.sharedLimiter(&s.limiters, user, s.Cfg.rateLimit(user), false)
+}
+
+// anonLimiter returns the limiter of the anonymous clients at ip, they are limited
+// by their IPs instead of sharing one limiter so a client can't starve the others
+func (s *Server) anonLimiter(ip net.IP) *userLimiter {
+	var (
+		key string
+	)
+
+	if ip != nil {
+		key = ip.String()
+	}
+
+	return s.sharedLimiter(&s.anonLimiters, key, s.Cfg.rateLimit(""), true)
+}
+
+// sharedLimiter returns the limiter of key in m, the idle limiters are dropped
+// first if prune is true and there are too many of them
+func (s *Server) sharedLimiter(m *map[string]*userLimiter, key string, rl *RateLimit, prune bool) *userLimiter {
+	var (
+		ul  *userLimiter
+		ok  bool
+		now = time.Now()
+	)
+
+	if rl == nil || (rl.Up <= 0 && rl.Down <= 0) {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ul, ok = (*m)[key]; ok {
+		return ul
+	}
+
+	if *m == nil {
+		*m = make(map[string]*userLimiter)
+	}
+
+	if prune && len(*m) >= anonLimitersPrune {
+		for k, l := range *m {
+			if l.up.full(now) && l.down.full(now) {
+				delete(*m, k)
+			}
+		}
+	}
+
+	ul = &userLimiter{
+		up:   newTokenBucket(rl.Up, rl.UpBurst),
+		down: newTokenBucket(rl.Down, rl.DownBurst),
+	}
+	(*m)[key] = ul
+
+	return ul
+}
+
+// limiter returns the limiter of the identity, or the one of the client IP if
+// it's anonymous
+func (c *conn) limiter() *userLimiter {
+	if name := c.userName(); name != "" {
+		return c.server.limiter(name)
+	}
+
+	return c.server.anonLimiter(remoteIP(c.netConn.RemoteAddr()))
+}
+
+// limitWriters wraps the writers towards the destination and the client by
+// the limiter of the conn
+func (c *conn) limitWriters(dst io.Writer, clt io.Writer) (io.Writer, io.Writer) {
+	var (
+		ul = c.limiter()
+	)
+
+	if ul == nil {
+		return dst, clt
+	}
+
+	return newLimitWriter(dst, ul.up), newLimitWriter(clt, ul.down)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitWriter(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		w     = newLimitWriter(&buf, newTokenBucket(10000, 1000))
+		start = time.Now()
+		n     int
+		err   error
+	)
+
+	// the first burst is free, the rest 2000 bytes take about 200ms
+	if n, err = w.Write(make([]byte, 3000)); err != nil || n != 3000 || buf.Len() != 3000 {
+		t.Fatal("Unexpected write result", n, err)
+	}
+
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Fatal("Unexpected duration", d)
+	}
+}
+
+func TestLimiterShared(t *testing.T) {
+	var (
+		s = &Server{Cfg: &Config{
+			RateLimit:      &RateLimit{Up: 100},
+			UserRateLimits: map[string]*RateLimit{"bob": {}},
+		}}
+	)
+
+	if s.limiter("alice") != s.limiter("alice") {
+		t.Fatal("Expected the limiter to be shared")
+	}
+
+	if s.limiter("bob") != nil {
+		t.Fatal("Expected bob to be unlimited")
+	}
+
+	if s.limiter("alice").down != nil {
+		t.Fatal("Expected the download to be unlimited")
+	}
+}
+
+func TestAnonLimiter(t *testing.T) {
+	var (
+		s = &Server{Cfg: &Config{RateLimit: &RateLimit{Up: 100}}}
+		a = net.IPv4(10, 0, 0, 1)
+		b = net.IPv4(10, 0, 0, 2)
+	)
+
+	if s.anonLimiter(a) != s.anonLimiter(a) {
+		t.Fatal("Expected the limiter to be shared by the same IP")
+	}
+
+	if s.anonLimiter(a) == s.anonLimiter(b) || s.anonLimiter(a) == s.limiter("") {
+		t.Fatal("Expected the anonymous clients to have their own limiters")
+	}
+
+	// the busy limiter of a is kept while the idle ones are dropped
+	s.anonLimiter(a).up.tokens = -1000
+	for i := 0; len(s.anonLimiters) < anonLimitersPrune; i++ {
+		s.anonLimiter(net.IPv4(10, 1, byte(i>>8), byte(i)))
+	}
+
+	s.anonLimiter(net.IPv4(10, 2, 0, 1))
+	if _, ok := s.anonLimiters[a.String()]; !ok || len(s.anonLimiters) != 2 {
+		t.Fatal("Unexpected limiters after pruning", len(s.anonLimiters))
+	}
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	resolverTypeUdp   = "udp"
+	resolverTypeTcp   = "tcp"
+	resolverTypeTls   = "tls"
+	resolverTypeHttps = "https"
+
+	dohMaxMessageSize = 65535
+)
+
+var (
+	ErrResolverInvalidType   = errors.New("Resolver: Type should be one of \"\", \"udp\", \"tcp\", \"tls\" and \"https\".")
+	ErrResolverNoServer      = errors.New("Resolver: a resolver should have at least one server.")
+	ErrResolverInvalidServer = errors.New("Resolver: invalid server.")
+	ErrResolverLoadCa        = errors.New("Resolver: failed to load CaFile.")
+	ErrResolverUnknown       = errors.New("Resolver: resolver is not in Resolvers.")
+	ErrResolverNoAddr        = errors.New("Resolver: no address of the host.")
+	ErrDohStatus             = errors.New("Resolver: unexpected status of DNS-over-HTTPS server.")
+)
+
+// Resolver looks up the IPs of host, network is "ip", "ip4" or "ip6". it's
+// satisfied by *net.Resolver
+type Resolver interface {
+	LookupIP(ctx context.Context, network string, host string) ([]net.IP, error)
+}
+
+// ResolverConfig is a resolver of nameservers, Type is "udp" by default, "tcp",
+// "tls" for DNS-over-TLS or "https" for DNS-over-HTTPS. Servers are "host:port",
+// the port is 53 or 853 for TLS by default, or URLs like "https://dns.example/dns-query"
+// for HTTPS. they are used in turn. ServerName is verified for TLS, it's the host
+// of the server by default, and CaFile is the CA bundle for TLS and HTTPS
+type ResolverConfig struct {
+	Type       string   `json:"Type"`
+	Servers    []string `json:"Servers"`
+	ServerName string   `json:"ServerName"`
+	CaFile     string   `json:"CaFile"`
+}
+
+// newResolver builds the resolver of rc, it's the pure Go resolver of the
+// standard library whose connections are made by us
+func newResolver(rc *ResolverConfig) (Resolver, error) {
+	var (
+		servers []string
+		tc      = &tls.Config{ServerName: rc.ServerName}
+		client  = &http.Client{Transport: &http.Transport{TLSClientConfig: tc, Proxy: nil}}
+		n       uint32
+		err     error
+	)
+
+	if len(rc.Servers) == 0 {
+		return nil, ErrResolverNoServer
+	}
+
+	for _, s := range rc.Servers {
+		switch rc.Type {
+		case "", resolverTypeUdp, resolverTypeTcp:
+			s, err = withDefaultPort(s, "53")
+		case resolverTypeTls:
+			s, err = withDefaultPort(s, "853")
+		case resolverTypeHttps:
+			if u, uErr := url.Parse(s); uErr != nil || u.Scheme != "https" || u.Host == "" {
+				err = ErrResolverInvalidServer
+			}
+		default:
+			return nil, ErrResolverInvalidType
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		servers = append(servers, s)
+	}
+
+	if rc.CaFile != "" {
+		if tc.RootCAs, err = loadCertPool(rc.CaFile); err != nil {
+			return nil, ErrResolverLoadCa
+		}
+	}
+
+	dialServer := func(ctx context.Context, network string) (net.Conn, error) {
+		var (
+			server = servers[int(atomic.AddUint32(&n, 1)-1)%len(servers)]
+			d      net.Dialer
+		)
+
+		switch rc.Type {
+		case resolverTypeTcp:
+			return d.DialContext(ctx, "tcp", server)
+		case resolverTypeTls:
+			c := tc.Clone()
+			if c.ServerName == "" {
+				c.ServerName, _, _ = net.SplitHostPort(server)
+			}
+
+			return (&tls.Dialer{Config: c}).DialContext(ctx, "tcp", server)
+		case resolverTypeHttps:
+			return &dohConn{ctx: ctx, client: client, url: server}, nil
+		default:
+			return d.DialContext(ctx, network, server)
+		}
+	}
+
+	// the responses are watched for the TTLs of the DNS cache
+	dial := func(ctx context.Context, network string, _ string) (net.Conn, error) {
+		nc, err := dialServer(ctx, network)
+		if err != nil {
+			return nil, err
+		}
+
+		return watchTtl(ctx, nc), nil
+	}
+
+	return &net.Resolver{PreferGo: true, Dial: dial}, nil
+}
+
+func withDefaultPort(s string, port string) (string, error) {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return s, nil
+	}
+
+	if s = strings.Trim(s, "[]"); s == "" {
+		return "", ErrResolverInvalidServer
+	}
+
+	return net.JoinHostPort(s, port), nil
+}
+
+// dohConn carries the DNS messages of the resolver over HTTPS, see RFC 8484.
+// the resolver writes and reads length-prefixed messages as over TCP since it's
+// not a net.PacketConn, each message written is POSTed and its response is
+// queued to be read
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	deadline time.Time
+	wbuf     bytes.Buffer
+	rbuf     bytes.Buffer
+}
+
+func (dc *dohConn) Write(b []byte) (int, error) {
+	var (
+		msg []byte
+		rep []byte
+		n   int
+		err error
+	)
+
+	dc.wbuf.Write(b)
+	for dc.wbuf.Len() >= 2 {
+		if n = int(dc.wbuf.Bytes()[0])<<8 | int(dc.wbuf.Bytes()[1]); dc.wbuf.Len() < 2+n {
+			break
+		}
+
+		dc.wbuf.Next(2)
+		msg = append([]byte{}, dc.wbuf.Next(n)...)
+		if rep, err = dc.roundTrip(msg); err != nil {
+			return 0, err
+		}
+
+		dc.rbuf.Write([]byte{byte(len(rep) >> 8), byte(len(rep))})
+		dc.rbuf.Write(rep)
+	}
+
+	return len(b), nil
+}
+
+func (dc *dohConn) roundTrip(msg []byte) ([]byte, error) {
+	var (
+		ctx    = dc.ctx
+		cancel context.CancelFunc
+		req    *http.Request
+		rep    *http.Response
+		b      []byte
+		err    error
+	)
+
+	if !dc.deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, dc.deadline)
+		defer cancel()
+	}
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, dc.url, bytes.NewReader(msg)); err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	if rep, err = dc.client.Do(req); err != nil {
+		return nil, err
+	}
+
+	defer rep.Body.Close()
+
+	if rep.StatusCode != http.StatusOK {
+		return nil, ErrDohStatus
+	}
+
+	if b, err = ioutil.ReadAll(io.LimitReader(rep.Body, dohMaxMessageSize)); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (dc *dohConn) Read(b []byte) (int, error) {
+	if dc.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return dc.rbuf.Read(b)
+}
+
+func (dc *dohConn) Close() error {
+	return nil
+}
+
+func (dc *dohConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (dc *dohConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// the deadline is applied to the requests sent by Write, Read never blocks
+func (dc *dohConn) SetDeadline(t time.Time) error {
+	dc.deadline = t
+	return nil
+}
+
+func (dc *dohConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (dc *dohConn) SetWriteDeadline(t time.Time) error {
+	dc.deadline = t
+	return nil
+}
+
+func (c *Config) compileResolvers() error {
+	var (
+		r   Resolver
+		err error
+	)
+
+	c.resolvers = make(map[string]Resolver)
+	for name, rc := range c.Resolvers {
+		if r, err = newResolver(rc); err != nil {
+			return err
+		}
+
+		c.resolvers[name] = r
+	}
+
+	c.sysResolver = net.DefaultResolver
+
+	if !c.DisableDnsCache {
+		c.dnsCache = newDnsCache(c)
+		for name, r := range c.resolvers {
+			c.resolvers[name] = &cachedResolver{name: name, r: r, cache: c.dnsCache}
+		}
+
+		c.sysResolver = &cachedResolver{r: net.DefaultResolver, cache: c.dnsCache}
+	}
+
+	names := []string{c.DefaultResolver}
+	for _, name := range c.UserResolvers {
+		names = append(names, name)
+	}
+
+	for _, r := range c.RouteRules {
+		names = append(names, r.Resolver)
+	}
+
+	for _, name := range names {
+		if _, ok := c.resolvers[name]; name != "" && !ok {
+			return ErrResolverUnknown
+		}
+	}
+
+	return nil
+}
+
+// resolver returns the resolver of the destination, it's chosen by the first
+// matched route rule with a Resolver, then by UserResolvers and DefaultResolver.
+// the rules with Cidrs never match since the IP is unknown yet
+func (c *Config) resolver(user string, host string, port int) Resolver {
+	var (
+		name string
+		ok   bool
+	)
+
+	if c.compile() != nil {
+		return net.DefaultResolver
+	}
+
+	for _, r := range c.RouteRules {
+		if r.Resolver != "" && r.match(user, host, nil, port) {
+			name = r.Resolver
+			break
+		}
+	}
+
+	if name == "" {
+		if name, ok = c.UserResolvers[user]; !ok {
+			name = c.DefaultResolver
+		}
+	}
+
+	if r, ok := c.resolvers[name]; ok {
+		return r
+	}
+
+	return c.sysResolver
+}
+
+// lookupHost returns the first IP of host to connect to for the user
+func (c *conn) lookupHost(host string, port int) (net.IP, error) {
+	ips, err := c.lookupHosts(host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	return ips[0], nil
+}
+
+// lookupHosts returns the IPs of host for the user in the order of PreferFamily
+func (c *conn) lookupHosts(host string, port int) ([]net.IP, error) {
+	var (
+		ips []net.IP
+		err error
+	)
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	if ips, err = c.server.Cfg.resolver(c.userName(), host, port).LookupIP(context.Background(), "ip", host); err != nil {
+		return nil, err
+	}
+
+	if ips = c.server.Cfg.sortByFamily(ips); len(ips) == 0 {
+		return nil, ErrResolverNoAddr
+	}
+
+	return ips, nil
+}
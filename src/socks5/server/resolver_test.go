@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dnsAnswer answers the A query of msg by records, the other queries get no answer
+func dnsAnswer(msg []byte, records map[string][]net.IP) []byte {
+	var (
+		i      = 12
+		labels []string
+		rep    []byte
+	)
+
+	if len(msg) < 12 {
+		return nil
+	}
+
+	for i < len(msg) && msg[i] != 0 {
+		labels = append(labels, string(msg[i+1:i+1+int(msg[i])]))
+		i += 1 + int(msg[i])
+	}
+
+	// the zero label, QTYPE and QCLASS
+	i += 5
+	if i > len(msg) {
+		return nil
+	}
+
+	ips, ok := records[strings.ToLower(strings.Join(labels, "."))]
+	rep = append([]byte{msg[0], msg[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, msg[12:i]...)
+	if !ok {
+		rep[3] |= 3
+		return rep
+	}
+
+	// the A records of QTYPE 1 and the AAAA records of QTYPE 28
+	for _, ip := range ips {
+		switch {
+		case msg[i-4] == 0 && msg[i-3] == 1 && ip.To4() != nil:
+			rep = append(rep, 0xC0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+			rep = append(rep, ip.To4()...)
+		case msg[i-4] == 0 && msg[i-3] == 28 && ip.To4() == nil:
+			rep = append(rep, 0xC0, 12, 0, 28, 0, 1, 0, 0, 0, 60, 0, 16)
+			rep = append(rep, ip...)
+		default:
+			continue
+		}
+
+		rep[7]++
+	}
+
+	return rep
+}
+
+// serveDnsStream answers the length-prefixed messages of c
+func serveDnsStream(c net.Conn, records map[string][]net.IP) {
+	var (
+		l   = make([]byte, 2)
+		msg []byte
+	)
+
+	defer c.Close()
+
+	for {
+		if _, err := io.ReadFull(c, l); err != nil {
+			return
+		}
+
+		msg = make([]byte, int(l[0])<<8|int(l[1]))
+		if _, err := io.ReadFull(c, msg); err != nil {
+			return
+		}
+
+		rep := dnsAnswer(msg, records)
+		c.Write(append([]byte{byte(len(rep) >> 8), byte(len(rep))}, rep...))
+	}
+}
+
+func acceptDns(l net.Listener, records map[string][]net.IP) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go serveDnsStream(c, records)
+	}
+}
+
+func TestResolverTypes(t *testing.T) {
+	var (
+		records = map[string][]net.IP{"cola.test": {net.IPv4(10, 9, 8, 7)}}
+		dir     string
+		pc      net.PacketConn
+		tl      net.Listener
+		sl      net.Listener
+		cert    tls.Certificate
+		err     error
+	)
+
+	if dir, err = ioutil.TempDir("", "cola"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer pc.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			pc.WriteTo(dnsAnswer(buf[:n], records), addr)
+		}
+	}()
+
+	if tl, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer tl.Close()
+	go acceptDns(tl, records)
+
+	certFile, keyFile := writeTestCert(t, dir, "dns.test")
+	if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if sl, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer sl.Close()
+	go acceptDns(sl, records)
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(msg, records))
+	}))
+
+	defer doh.Close()
+
+	dohCa := filepath.Join(dir, "doh.pem")
+	ioutil.WriteFile(dohCa, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: doh.Certificate().Raw}), 0600)
+
+	for _, rc := range []*ResolverConfig{
+		{Servers: []string{pc.LocalAddr().String()}},
+		{Type: resolverTypeTcp, Servers: []string{tl.Addr().String()}},
+		{Type: resolverTypeTls, Servers: []string{sl.Addr().String()}, ServerName: "dns.test", CaFile: certFile},
+		{Type: resolverTypeHttps, Servers: []string{doh.URL + "/dns-query"}, CaFile: dohCa},
+	} {
+		r, err := newResolver(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ips, err := r.LookupIP(context.Background(), "ip4", "cola.test.")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(records["cola.test"][0]) {
+			t.Fatal("Unexpected result of", rc.Type, ips, err)
+		}
+	}
+}
+
+func TestResolverChoice(t *testing.T) {
+	var (
+		cfg = &Config{
+			Resolvers: map[string]*ResolverConfig{
+				"corp":   {Servers: []string{"10.0.0.53"}},
+				"bob":    {Type: resolverTypeTcp, Servers: []string{"10.0.1.53"}},
+				"public": {Type: resolverTypeTls, Servers: []string{"1.1.1.1"}},
+			},
+			UserResolvers:   map[string]string{"bob": "bob"},
+			DefaultResolver: "public",
+			RouteRules: []*RouteRule{
+				{Action: routeActionDirect, Resolver: "corp", DomainSuffixes: []string{"corp.example.com"}},
+			},
+		}
+	)
+
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.resolver("bob", "wiki.corp.example.com", 443) != cfg.resolvers["corp"] {
+		t.Fatal("Expected the resolver of the rule")
+	}
+
+	if cfg.resolver("bob", "example.com", 443) != cfg.resolvers["bob"] {
+		t.Fatal("Expected the resolver of the user")
+	}
+
+	if cfg.resolver("alice", "example.com", 443) != cfg.resolvers["public"] {
+		t.Fatal("Expected the default resolver")
+	}
+
+	if (&Config{DisableDnsCache: true}).resolver("", "example.com", 443) != net.DefaultResolver {
+		t.Fatal("Expected the system resolver")
+	}
+}
+
+func TestResolverCheck(t *testing.T) {
+	var (
+		cases = map[*Config]error{
+			{Resolvers: map[string]*ResolverConfig{"a": {}}}:                                                   ErrResolverNoServer,
+			{Resolvers: map[string]*ResolverConfig{"a": {Type: "quic", Servers: []string{"1.1.1.1"}}}}:         ErrResolverInvalidType,
+			{Resolvers: map[string]*ResolverConfig{"a": {Type: "https", Servers: []string{"1.1.1.1"}}}}:        ErrResolverInvalidServer,
+			{Resolvers: map[string]*ResolverConfig{"a": {Servers: []string{"1.1.1.1"}}}, DefaultResolver: "b"}: ErrResolverUnknown,
+			{UserResolvers: map[string]string{"bob": "b"}}:                                                     ErrResolverUnknown,
+		}
+	)
+
+	for cfg, expected := range cases {
+		if err := cfg.compileResolvers(); err != expected {
+			t.Fatal("Unexpected result", err, expected)
+		}
+	}
+}
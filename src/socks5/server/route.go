@@ -0,0 +1,224 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	routeActionDirect   = "direct"
+	routeActionUpstream = "upstream"
+	routeActionReject   = "reject"
+)
+
+var (
+	ErrRouteRejected       = errors.New("Route: destination is rejected by route rules.")
+	ErrRouteInvalidAction  = errors.New("Route: Action should be \"direct\", \"upstream\" or \"reject\".")
+	ErrRouteInvalidRegex   = errors.New("Route: invalid domain regex.")
+	ErrRouteInvalidCidr    = errors.New("Route: invalid CIDR.")
+	ErrRouteUnknownUpsteam = errors.New("Route: Upstream is not in Upstreams or UpstreamPools.")
+	ErrRouteNotRelayable   = errors.New("Route: UDP and BIND can't be relayed by upstream proxies.")
+)
+
+// RouteRule decides how the destinations it matches are reached, Action is
+// "direct", "upstream" with the name of Upstream or "reject". a rule matches if
+// all of its non-empty fields match. DomainSuffixes match the domain and its
+// subdomains, DomainKeywords match the domains containing them, DomainRegexes
+// are matched against the whole domain, Ports are like "443" or "8000-9000" and
+// Users are the names of identities. Resolver is the resolver of the domains it
+// matches, see Config.Resolvers
+type RouteRule struct {
+	Action         string   `json:"Action"`
+	Upstream       string   `json:"Upstream"`
+	Resolver       string   `json:"Resolver"`
+	DomainSuffixes []string `json:"DomainSuffixes"`
+	DomainKeywords []string `json:"DomainKeywords"`
+	DomainRegexes  []string `json:"DomainRegexes"`
+	Cidrs          []string `json:"Cidrs"`
+	Ports          []string `json:"Ports"`
+	Users          []string `json:"Users"`
+
+	regexes []*regexp.Regexp
+	nets    []*net.IPNet
+	ports   [][2]int
+}
+
+func (r *RouteRule) compile(hasUpstream func(name string) bool) error {
+	var (
+		re  *regexp.Regexp
+		lo  int
+		hi  int
+		err error
+	)
+
+	switch r.Action {
+	case routeActionDirect, routeActionReject:
+	case routeActionUpstream:
+		if !hasUpstream(r.Upstream) {
+			return ErrRouteUnknownUpsteam
+		}
+	default:
+		return ErrRouteInvalidAction
+	}
+
+	r.regexes = nil
+	for _, s := range r.DomainRegexes {
+		if re, err = regexp.Compile(s); err != nil {
+			return ErrRouteInvalidRegex
+		}
+
+		r.regexes = append(r.regexes, re)
+	}
+
+	if r.nets, err = parseCidrs(r.Cidrs); err != nil {
+		return ErrRouteInvalidCidr
+	}
+
+	r.ports = nil
+	for _, p := range r.Ports {
+		if lo, hi, err = parsePortRange(p); err != nil {
+			return err
+		}
+
+		r.ports = append(r.ports, [2]int{lo, hi})
+	}
+
+	return nil
+}
+
+// match reports whether the rule matches the destination of the user, domain
+// is "" if the client asked for an IP address
+func (r *RouteRule) match(user string, domain string, ip net.IP, port int) bool {
+	return r.matchHost(user, domain, port) && (len(r.nets) == 0 || matchAny(len(r.nets), func(i int) bool {
+		return ip != nil && r.nets[i].Contains(ip)
+	}))
+}
+
+// matchHost matches the fields of the rule other than Cidrs
+func (r *RouteRule) matchHost(user string, domain string, port int) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if len(r.DomainSuffixes) > 0 && !matchAny(len(r.DomainSuffixes), func(i int) bool {
+		s := strings.ToLower(strings.TrimPrefix(r.DomainSuffixes[i], "."))
+		return domain != "" && (domain == s || strings.HasSuffix(domain, "."+s))
+	}) {
+		return false
+	}
+
+	if len(r.DomainKeywords) > 0 && !matchAny(len(r.DomainKeywords), func(i int) bool {
+		return domain != "" && strings.Contains(domain, strings.ToLower(r.DomainKeywords[i]))
+	}) {
+		return false
+	}
+
+	if len(r.regexes) > 0 && !matchAny(len(r.regexes), func(i int) bool {
+		return domain != "" && r.regexes[i].MatchString(domain)
+	}) {
+		return false
+	}
+
+	if len(r.ports) > 0 && !matchAny(len(r.ports), func(i int) bool {
+		return port >= r.ports[i][0] && port <= r.ports[i][1]
+	}) {
+		return false
+	}
+
+	if len(r.Users) > 0 && !matchAny(len(r.Users), func(i int) bool {
+		return r.Users[i] == user
+	}) {
+		return false
+	}
+
+	return true
+}
+
+func matchAny(n int, match func(i int) bool) bool {
+	for i := 0; i < n; i++ {
+		if match(i) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Config) compileRoutes() error {
+	for _, r := range c.RouteRules {
+		if err := r.compile(c.hasUpstream); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// route returns the first rule which matches the destination of the user, nil
+// if none of them matches
+func (c *Config) route(user string, host string, ip net.IP, port int) (*RouteRule, error) {
+	var (
+		domain string
+		err    error
+	)
+
+	// fail closed if the rules are broken
+	if err = c.compile(); err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) == nil {
+		domain = host
+	}
+
+	for _, r := range c.RouteRules {
+		if r.match(user, domain, ip, port) {
+			return r, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// routeNeedsIp reports whether the IP of the domain decides the route, it's true
+// if a rule with Cidrs is reached before any rule without Cidrs matches
+func (c *Config) routeNeedsIp(user string, domain string, port int) bool {
+	if c.compile() != nil {
+		return false
+	}
+
+	for _, r := range c.RouteRules {
+		if r.matchHost(user, domain, port) {
+			return len(r.nets) > 0
+		}
+	}
+
+	return false
+}
+
+// checkLocalRoute checks the destinations of UDP datagrams and the peers of BIND
+// which are relayed by the server itself. the upstream proxies only carry CONNECT,
+// so the destinations routed to them are refused as well as the rejected ones
+func (c *Config) checkLocalRoute(user string, host string, ip net.IP, port int) error {
+	var (
+		r   *RouteRule
+		err error
+	)
+
+	if r, err = c.route(user, host, ip, port); err != nil {
+		return err
+	}
+
+	switch {
+	case r == nil && c.DefaultUpstream != "":
+		return ErrRouteNotRelayable
+	case r == nil:
+		return nil
+	case r.Action == routeActionReject:
+		return ErrRouteRejected
+	case r.Action == routeActionUpstream:
+		return ErrRouteNotRelayable
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRouteMatch(t *testing.T) {
+	var (
+		cfg = &Config{
+			Upstreams: map[string][]*UpstreamHop{"corp": {{Type: upstreamTypeSocks5, Addr: "10.0.0.1:1080"}}},
+			RouteRules: []*RouteRule{
+				{Action: routeActionReject, DomainKeywords: []string{"ads"}},
+				{Action: routeActionUpstream, Upstream: "corp", DomainSuffixes: []string{"corp.example.com"}},
+				{Action: routeActionUpstream, Upstream: "corp", DomainRegexes: []string{`^git\d+\.`}, Ports: []string{"22"}},
+				{Action: routeActionDirect, Cidrs: []string{"10.0.0.0/8"}, Users: []string{"alice"}},
+				{Action: routeActionReject, Cidrs: []string{"10.0.0.0/8"}},
+			},
+		}
+		cases = []struct {
+			user   string
+			host   string
+			ip     string
+			port   int
+			action string
+		}{
+			{"", "ads.example.com", "1.2.3.4", 443, routeActionReject},
+			{"", "corp.example.com", "1.2.3.4", 443, routeActionUpstream},
+			{"", "wiki.CORP.example.com.", "1.2.3.4", 443, routeActionUpstream},
+			{"", "notcorp.example.com", "1.2.3.4", 443, ""},
+			{"", "git1.example.com", "1.2.3.4", 22, routeActionUpstream},
+			{"", "git1.example.com", "1.2.3.4", 443, ""},
+			{"alice", "10.1.1.1", "10.1.1.1", 80, routeActionDirect},
+			{"bob", "10.1.1.1", "10.1.1.1", 80, routeActionReject},
+		}
+	)
+
+	if err := cfg.compileRoutes(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		r, err := cfg.route(c.user, c.host, net.ParseIP(c.ip), c.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (r == nil && c.action != "") || (r != nil && r.Action != c.action) {
+			t.Fatal("Unexpected route of", c.user, c.host, c.port, r)
+		}
+	}
+}
+
+func TestRouteCompile(t *testing.T) {
+	var (
+		cases = map[*RouteRule]error{
+			{Action: "proxy"}: ErrRouteInvalidAction,
+			{Action: routeActionUpstream, Upstream: "none"}:             ErrRouteUnknownUpsteam,
+			{Action: routeActionDirect, DomainRegexes: []string{"("}}:   ErrRouteInvalidRegex,
+			{Action: routeActionDirect, Cidrs: []string{"10.0.0.0/33"}}: ErrRouteInvalidCidr,
+			{Action: routeActionReject, Ports: []string{"2-1"}}:         ErrAclInvalidPorts,
+		}
+	)
+
+	for r, expected := range cases {
+		if err := r.compile((&Config{}).hasUpstream); err != expected {
+			t.Fatal("Unexpected result", err, expected)
+		}
+	}
+}
+
+func TestRouteReject(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		srv  = listenServer(t, &Config{RouteRules: []*RouteRule{{Action: routeActionReject, Ports: []string{"1-65535"}}}})
+		port = echo.Addr().(*net.TCPAddr).Port
+		nc   net.Conn
+		buf  = make([]byte, 10)
+		err  error
+	)
+
+	defer echo.Close()
+	defer srv.Close()
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	nc.Write([]byte{version5, 1, authMethodBare})
+	if _, err = io.ReadFull(nc, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	nc.Write([]byte{version5, cmdConnect, reqRsv, aTypIpv4, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != repNotAllowed {
+		t.Fatal("Expected the destination to be rejected", buf, err)
+	}
+}
+
+func TestRouteLocal(t *testing.T) {
+	var (
+		ups = map[string][]*UpstreamHop{"up": {{Type: upstreamTypeSocks5, Addr: "10.0.0.1:1080"}}}
+		cfg = &Config{
+			Upstreams: ups,
+			RouteRules: []*RouteRule{
+				{Action: routeActionReject, DomainSuffixes: []string{"ads.example.com"}},
+				{Action: routeActionUpstream, Upstream: "up", Ports: []string{"53"}},
+				{Action: routeActionDirect, Ports: []string{"443"}},
+			},
+		}
+	)
+
+	if err := cfg.checkLocalRoute("", "x.ads.example.com", nil, 443); err != ErrRouteRejected {
+		t.Fatal("Expected the destination to be rejected", err)
+	}
+
+	if err := cfg.checkLocalRoute("", "8.8.8.8", net.IPv4(8, 8, 8, 8), 53); err != ErrRouteNotRelayable {
+		t.Fatal("Expected the upstream route to be refused", err)
+	}
+
+	if err := cfg.checkLocalRoute("", "example.com", nil, 443); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.DefaultUpstream = "up"
+	if err := cfg.checkLocalRoute("", "example.com", nil, 80); err != ErrRouteNotRelayable {
+		t.Fatal("Expected DefaultUpstream to be refused", err)
+	}
+}
+
+func TestRouteRejectBind(t *testing.T) {
+	var (
+		srv = listenServer(t, &Config{RouteRules: []*RouteRule{{Action: routeActionReject, Cidrs: []string{"127.0.0.0/8"}}}})
+		nc  net.Conn
+		buf = make([]byte, 10)
+		err error
+	)
+
+	defer srv.Close()
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	nc.Write([]byte{version5, 1, authMethodBare})
+	if _, err = io.ReadFull(nc, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	nc.Write([]byte{version5, cmdBind, reqRsv, aTypIpv4, 127, 0, 0, 1, 0, 80})
+	if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != repNotAllowed {
+		t.Fatal("Expected the peer to be rejected", buf, err)
+	}
+}
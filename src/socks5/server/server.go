@@ -2,44 +2,82 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
 type Server struct {
 	Cfg       *Config
 	StartTime time.Time
+	// Auth checks the credentials of clients, Cfg.UsrPwdPairs is used if it's nil
+	Auth Authenticator
+	// Dialer connects to destinations, the upstream chain of Cfg is used if it's nil.
+	// the destinations rejected by the route rules are still refused
+	Dialer Dialer
+
+	mu        sync.Mutex
+	sessions6 *socks6Sessions
+	limiters  map[string]*userLimiter
+	quotas    map[string]*userQuota
+	pools     map[string]*upstreamPool
+
+	// anonLimiters are the limiters of anonymous clients by their IPs
+	anonLimiters map[string]*userLimiter
+
+	// traffic is guarded by trafficMu so the relays don't contend with the others on mu
+	trafficOnce  sync.Once
+	trafficMu    sync.Mutex
+	traffic      map[string]*TrafficUsage
+	trafficDirty bool
+
+	// trafficWriters are the writers of the live relays, guarded by trafficMu
+	trafficWriters map[*trafficWriter]bool
 }
 
 var (
 	ErrCannotListen = errors.New("Faild to create TCP listener.")
 )
 
+// ListenAndServe listens on Cfg.ServerPort, the listener is wrapped in TLS if Cfg.UseTls is true
 func (s *Server) ListenAndServe() error {
 	var (
 		l    *net.TCPListener
 		addr *net.TCPAddr
+		tc   *tls.Config
 		err  error
 	)
 
 	addr = &net.TCPAddr{
-		[]byte{0, 0, 0, 0},
-		int(s.Cfg.ServerPort),
-		"",
+		IP:   []byte{0, 0, 0, 0},
+		Port: int(s.Cfg.ServerPort),
+	}
+
+	if s.Cfg.UseTls {
+		if tc, err = s.Cfg.tlsConfig(); err != nil {
+			return err
+		}
 	}
 
 	if l, err = net.ListenTCP("tcp", addr); err != nil {
 		return ErrCannotListen
 	}
 
+	if tc != nil {
+		return s.Serve(tls.NewListener(l, tc))
+	}
+
 	return s.Serve(l)
 }
 
 func (s *Server) Serve(l net.Listener) error {
 	defer l.Close()
 
+	s.startTraffic()
+
 	var (
 		nec  net.Conn
 		err  error
@@ -59,6 +97,8 @@ func (s *Server) Serve(l net.Listener) error {
 		}
 
 		if conn, err = s.NewConn(nec); err != nil {
+			s.Log(err, nec.RemoteAddr())
+			nec.Close()
 			continue
 		}
 
@@ -66,9 +106,20 @@ func (s *Server) Serve(l net.Listener) error {
 	}
 }
 
+// NewConn creates the conn of an accepted connection, ErrSourceDenied is returned
+// if the client address is not allowed
 func (s *Server) NewConn(netConn net.Conn) (*conn, error) {
+	var (
+		ip = remoteIP(netConn.RemoteAddr())
+	)
+
+	if !s.Cfg.allowClient(ip) {
+		return nil, ErrSourceDenied
+	}
+
 	c := new(conn)
 
+	c.bareIdentity = s.Cfg.ipIdentity(ip)
 	c.netConn = netConn
 	c.server = s
 	c.br = bufio.NewReader(netConn)
@@ -79,3 +130,22 @@ func (s *Server) NewConn(netConn net.Conn) (*conn, error) {
 func (s *Server) Log(args ...interface{}) {
 	log.Println(args...)
 }
+
+func (s *Server) socks6Sessions() *socks6Sessions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions6 == nil {
+		s.sessions6 = newSocks6Sessions()
+	}
+
+	return s.sessions6
+}
+
+func (s *Server) authenticator() Authenticator {
+	if s.Auth != nil {
+		return s.Auth
+	}
+
+	return s.Cfg.UsrPwdPairs
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	version4 = byte(4)
+
+	rep4Version        = byte(0)
+	rep4Granted        = byte(90)
+	rep4Rejected       = byte(91)
+	rep4UserIdRejected = byte(93)
+
+	// max length of USERID and the domain of SOCKS4a
+	socks4MaxFieldLen = 255
+
+	socks4AuthNone  = ""
+	socks4AuthUnPwd = "unpwd"
+	socks4AuthIdent = "ident"
+)
+
+var (
+	ErrSocks4ReadBytes      = errors.New("Socks4: failed to read request bytes.")
+	ErrSocks4FieldTooLong   = errors.New("Socks4: USERID or domain is too long.")
+	ErrSocks4UnsupportedCmd = errors.New("Socks4: unsupported command.")
+	ErrSocks4InvalidUserId  = errors.New("Socks4: USERID was rejected.")
+	ErrSocks4AuthRequired   = errors.New("Socks4: method 0 isn't allowed, set Socks4Auth to authenticate.")
+	ErrSocks4InvalidDstAddr = errors.New("Socks4: invalid destination address.")
+	ErrSocks4WriteReplay    = errors.New("Socks4: failed to write replay.")
+)
+
+// negotiate4 reads the SOCKS4 request and checks its USERID, SOCKS4a is detected
+// by DSTIP being 0.0.0.x with x non-zero, the domain follows the USERID then.
+// see http://ftp.icm.edu.pl/packages/socks/socks4/SOCKS4.protocol and
+// https://www.openssh.com/txt/socks4a.protocol
+func (c *conn) negotiate4() error {
+	var (
+		buf    = make([]byte, 8)
+		err    error
+		userId string
+		host   string
+		port   uint16
+	)
+
+	if _, err = io.ReadFull(c.br, buf); err != nil {
+		return ErrSocks4ReadBytes
+	}
+
+	c.cmd = buf[1]
+	port = uint16(buf[2])<<8 + uint16(buf[3])
+
+	if userId, err = c.readNulString4(); err != nil {
+		return err
+	}
+
+	if buf[4] == 0 && buf[5] == 0 && buf[6] == 0 && buf[7] != 0 {
+		if host, err = c.readNulString4(); err != nil {
+			return err
+		}
+
+		c.aTyp = aTypDomain
+	} else {
+		host = net.IP(buf[4:8]).String()
+		c.aTyp = aTypIpv4
+	}
+
+	c.dstHost = net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	if err = c.authUserId4(userId); err != nil {
+		if err == ErrSocks4AuthRequired {
+			c.writeReplay4(rep4Rejected, nil)
+		} else {
+			c.writeReplay4(rep4UserIdRejected, nil)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// authUserId4 checks the USERID according to Config.Socks4Auth, the identity
+// is the username for "unpwd" and the USERID itself for "ident". the clients
+// with an identity mapped from their certificate or address skip the check.
+// the USERID is ignored if Socks4Auth is "", the clients are anonymous then and
+// they are accepted only if method 0 is allowed
+func (c *conn) authUserId4(userId string) error {
+	var (
+		cfg = c.server.Cfg
+		i   int
+	)
+
+	if c.bareIdentity != nil {
+		c.identity = c.bareIdentity
+		return nil
+	}
+
+	switch cfg.Socks4Auth {
+	case socks4AuthUnPwd:
+		if i = strings.IndexByte(userId, ':'); i <= 0 {
+			return ErrSocks4InvalidUserId
+		}
+
+		c.method = authMethodUnPwd
+		return c.authenticate(userId[:i], userId[i+1:])
+	case socks4AuthIdent:
+		for _, id := range cfg.Socks4UserIds {
+			if id == userId {
+				c.identity = &Identity{Name: userId}
+				return nil
+			}
+		}
+
+		return ErrSocks4InvalidUserId
+	default:
+		if !c.acceptBare() {
+			return ErrSocks4AuthRequired
+		}
+
+		return nil
+	}
+}
+
+// exchange4 serves CONNECT and BIND of SOCKS4 with the same procedures of SOCKS5
+func (c *conn) exchange4() error {
+	var (
+		err error
+	)
+
+	switch c.cmd {
+	case cmdConnect, cmdBind:
+	default:
+		c.server.Log(ErrSocks4UnsupportedCmd)
+		return c.writeReplay4(rep4Rejected, nil)
+	}
+
+	if err = c.resolveDstAddr(); err != nil {
+		c.server.Log(ErrSocks4InvalidDstAddr)
+		return c.writeReplay4(rep4Rejected, nil)
+	}
+
+	if c.cmd == cmdBind {
+		return c.bind()
+	}
+
+	if err = c.prepareExchange(); err != nil {
+		c.server.Log(err)
+		return c.writeReplay4(rep4Rejected, nil)
+	}
+
+	if err = c.writeReplay4(rep4Granted, tcpAddrOf(c.dstConn.LocalAddr())); err != nil {
+		return err
+	}
+
+	return c.relay()
+}
+
+func (c *conn) readNulString4() (string, error) {
+	var (
+		b   []byte
+		err error
+	)
+
+	for {
+		var (
+			ch byte
+		)
+
+		if ch, err = c.br.ReadByte(); err != nil {
+			return "", ErrSocks4ReadBytes
+		}
+
+		if ch == 0 {
+			return string(b), nil
+		}
+
+		if len(b) == socks4MaxFieldLen {
+			return "", ErrSocks4FieldTooLong
+		}
+
+		b = append(b, ch)
+	}
+}
+
+// writeReplay4 writes the SOCKS4 replay, only IPv4 address can be carried by it
+// so others are sent as 0.0.0.0
+func (c *conn) writeReplay4(code byte, addr *net.TCPAddr) error {
+	var (
+		rep = []byte{rep4Version, code, 0, 0, 0, 0, 0, 0}
+		ip4 net.IP
+	)
+
+	if addr != nil {
+		rep[2], rep[3] = byte(addr.Port>>8), byte(addr.Port)
+		if ip4 = addr.IP.To4(); ip4 != nil {
+			copy(rep[4:], ip4)
+		}
+	}
+
+	if _, err := c.netConn.Write(rep); err != nil {
+		return ErrSocks4WriteReplay
+	}
+
+	if code != rep4Granted {
+		c.close()
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// dial4 sends a SOCKS4 CONNECT to srv, a SOCKS4a request is sent if host isn't empty
+func dial4(t *testing.T, srv net.Listener, dst *net.TCPAddr, userId string, host string) (net.Conn, []byte) {
+	var (
+		nc  net.Conn
+		req = []byte{version4, cmdConnect, byte(dst.Port >> 8), byte(dst.Port)}
+		rep = make([]byte, 8)
+		err error
+	)
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	if host != "" {
+		req = append(req, 0, 0, 0, 1)
+	} else {
+		req = append(req, dst.IP.To4()...)
+	}
+
+	req = append(append(req, userId...), 0)
+	if host != "" {
+		req = append(append(req, host...), 0)
+	}
+
+	nc.Write(req)
+	if _, err = io.ReadFull(nc, rep); err != nil {
+		t.Fatal(err)
+	}
+
+	return nc, rep
+}
+
+func TestSocks4Connect(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		srv  = listenServer(t, &Config{})
+		dst  = echo.Addr().(*net.TCPAddr)
+		buf  = make([]byte, 5)
+	)
+
+	defer echo.Close()
+	defer srv.Close()
+
+	for _, host := range []string{"", "localhost"} {
+		nc, rep := dial4(t, srv, dst, "anyone", host)
+		if rep[1] != rep4Granted {
+			t.Fatal("Unexpected replay", host, rep)
+		}
+
+		nc.Write([]byte("hello"))
+		if _, err := io.ReadFull(nc, buf); err != nil || string(buf) != "hello" {
+			t.Fatal("Unexpected echo", buf, err)
+		}
+
+		nc.Close()
+	}
+}
+
+func TestSocks4AuthRequired(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		srv  = listenServer(t, &Config{AuthMethods: []uint8{authMethodUnPwd}, UsrPwdPairs: UsrPwdPairs{"Usr1": "Pwd1"}})
+		dst  = echo.Addr().(*net.TCPAddr)
+	)
+
+	defer echo.Close()
+	defer srv.Close()
+
+	nc, rep := dial4(t, srv, dst, "Usr1", "")
+	defer nc.Close()
+
+	if rep[1] != rep4Rejected {
+		t.Fatal("Expected anonymous SOCKS4 clients to be rejected", rep)
+	}
+}
+
+func TestSocks4AuthUnPwd(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		srv  = listenServer(t, &Config{
+			AuthMethods: []uint8{authMethodUnPwd},
+			UsrPwdPairs: UsrPwdPairs{"Usr1": "Pwd1"},
+			Socks4Auth:  socks4AuthUnPwd,
+		})
+		dst = echo.Addr().(*net.TCPAddr)
+	)
+
+	defer echo.Close()
+	defer srv.Close()
+
+	nc, rep := dial4(t, srv, dst, "Usr1:Pwd1", "")
+	nc.Close()
+
+	if rep[1] != rep4Granted {
+		t.Fatal("Unexpected replay", rep)
+	}
+
+	nc, rep = dial4(t, srv, dst, "Usr1:wrong", "")
+	nc.Close()
+
+	if rep[1] != rep4UserIdRejected {
+		t.Fatal("Expected the USERID to be rejected", rep)
+	}
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"socks6"
+	"sync"
+	"time"
+)
+
+const (
+	socks6SessionIdLen   = 16
+	socks6SessionTimeout = 10 * time.Minute
+	socks6MaxTokenWindow = uint32(1024)
+	socks6MaxSessions    = 4096
+)
+
+var (
+	ErrSocks6AuthFailed       = errors.New("Socks6: authentication failed.")
+	ErrSocks6SessionInvalid   = errors.New("Socks6: invalid session.")
+	ErrSocks6SessionCreate    = errors.New("Socks6: failed to create session.")
+	ErrSocks6TooManySessions  = errors.New("Socks6: too many sessions.")
+	ErrSocks6TokenRejected    = errors.New("Socks6: idempotence token was rejected.")
+	ErrSocks6ReadInitialData  = errors.New("Socks6: failed to read initial data.")
+	ErrSocks6WriteInitialData = errors.New("Socks6: failed to write initial data.")
+	ErrSocks6WriteReplay      = errors.New("Socks6: failed to write replay.")
+)
+
+// socks6Req keeps the state of a SOCKS6 request between negotiate6 and exchange6
+type socks6Req struct {
+	req      *socks6.Request
+	session  *socks6Session
+	teardown bool
+}
+
+type socks6Session struct {
+	id        string
+	method    byte
+	identity  *Identity
+	expire    time.Time
+	tokenBase uint32
+	tokenSize uint32
+	spent     map[uint32]bool
+}
+
+// socks6Sessions holds the sessions of a server, expired ones are removed lazily.
+// at most socks6MaxSessions sessions are kept since they can be created by the
+// clients which don't authenticate
+type socks6Sessions struct {
+	mu sync.Mutex
+	m  map[string]*socks6Session
+}
+
+func newSocks6Sessions() *socks6Sessions {
+	return &socks6Sessions{m: make(map[string]*socks6Session)}
+}
+
+func (ss *socks6Sessions) create(method byte, identity *Identity) (*socks6Session, error) {
+	var (
+		id = make([]byte, socks6SessionIdLen)
+		s  *socks6Session
+	)
+
+	if _, err := rand.Read(id); err != nil {
+		return nil, ErrSocks6SessionCreate
+	}
+
+	s = &socks6Session{
+		id:       string(id),
+		method:   method,
+		identity: identity,
+		expire:   time.Now().Add(socks6SessionTimeout),
+		spent:    make(map[uint32]bool),
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.purge()
+	if len(ss.m) >= socks6MaxSessions {
+		return nil, ErrSocks6TooManySessions
+	}
+
+	ss.m[s.id] = s
+
+	return s, nil
+}
+
+// get returns the session and extends its lifetime, nil is returned if
+// the session doesn't exist or was expired
+func (ss *socks6Sessions) get(id []byte) *socks6Session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.purge()
+	if s, ok := ss.m[string(id)]; ok {
+		s.expire = time.Now().Add(socks6SessionTimeout)
+		return s
+	}
+
+	return nil
+}
+
+func (ss *socks6Sessions) remove(s *socks6Session) {
+	ss.mu.Lock()
+	delete(ss.m, s.id)
+	ss.mu.Unlock()
+}
+
+// grantTokens moves the token window of the session forward, the spent tokens
+// of the old window are forgotten
+func (ss *socks6Sessions) grantTokens(s *socks6Session, size uint32) (uint32, uint32) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if size > socks6MaxTokenWindow {
+		size = socks6MaxTokenWindow
+	}
+
+	s.tokenBase += s.tokenSize
+	s.tokenSize = size
+	s.spent = make(map[uint32]bool)
+
+	return s.tokenBase, s.tokenSize
+}
+
+// spendToken reports whether the token is in the window and hasn't been spent
+func (ss *socks6Sessions) spendToken(s *socks6Session, token uint32) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if token-s.tokenBase >= s.tokenSize || s.spent[token] {
+		return false
+	}
+
+	s.spent[token] = true
+	return true
+}
+
+func (ss *socks6Sessions) purge() {
+	var (
+		now = time.Now()
+	)
+
+	for id, s := range ss.m {
+		if now.After(s.expire) {
+			delete(ss.m, id)
+		}
+	}
+}
+
+// negotiate6 reads the SOCKS6 request and authenticates it, the request is
+// either authenticated by the auth data inside it or by a session id
+func (c *conn) negotiate6() error {
+	var (
+		req *socks6.Request
+		rep = &socks6.AuthReply{Type: socks6.AuthSucceeded}
+		ss  = c.server.socks6Sessions()
+		o   socks6.Option
+		ok  bool
+		err error
+	)
+
+	if req, err = socks6.ReadRequest(c.br); err != nil {
+		return err
+	}
+
+	c.s6 = &socks6Req{req: req}
+
+	if o, ok = req.Options.Get(socks6.OptSessionId); ok {
+		if c.s6.session = ss.get(o.Data); c.s6.session == nil {
+			rep.Type = socks6.AuthFailed
+			rep.Options = append(rep.Options, socks6.Option{Kind: socks6.OptSessionInvalid})
+			if err = c.writeAuthReplay6(rep); err != nil {
+				return err
+			}
+
+			return ErrSocks6SessionInvalid
+		}
+
+		c.method, c.identity = c.s6.session.method, c.s6.session.identity
+		rep.Options = append(rep.Options, socks6.Option{Kind: socks6.OptSessionOk})
+		c.s6.teardown = req.Options.Has(socks6.OptSessionTeardown)
+	} else {
+		if err = c.authenticate6(req); err != nil {
+			rep.Type = socks6.AuthFailed
+			if wErr := c.writeAuthReplay6(rep); wErr != nil {
+				return wErr
+			}
+
+			return err
+		}
+
+		rep.Options = append(rep.Options, socks6.AuthMethodSelectOption(c.method))
+
+		if req.Options.Has(socks6.OptSessionRequest) {
+			// the request is still served without a session if it can't be created
+			if c.s6.session, err = ss.create(c.method, c.identity); err != nil {
+				c.server.Log(err)
+			} else {
+				rep.Options = append(rep.Options, socks6.SessionIdOption([]byte(c.s6.session.id)))
+			}
+		}
+	}
+
+	if c.s6.session != nil {
+		if o, ok = req.Options.Get(socks6.OptTokenRequest); ok {
+			if size, err := o.Uint32(0); err == nil {
+				rep.Options = append(rep.Options, socks6.IdempotenceWindowOption(ss.grantTokens(c.s6.session, size)))
+			}
+		}
+
+		if o, ok = req.Options.Get(socks6.OptIdempotenceExpenditure); ok {
+			if token, err := o.Uint32(0); err == nil && ss.spendToken(c.s6.session, token) {
+				rep.Options = append(rep.Options, socks6.Option{Kind: socks6.OptIdempotenceAccepted})
+			} else {
+				rep.Options = append(rep.Options, socks6.Option{Kind: socks6.OptIdempotenceRejected})
+				if err = c.writeAuthReplay6(rep); err != nil {
+					return err
+				}
+
+				return ErrSocks6TokenRejected
+			}
+		}
+	}
+
+	return c.writeAuthReplay6(rep)
+}
+
+// authenticate6 checks the auth data inside the request, method 0 is always
+// implied by SOCKS6 so the request without auth data is accepted if method 0
+// is allowed by the config
+func (c *conn) authenticate6(req *socks6.Request) error {
+	var (
+		o   socks6.Option
+		ok  bool
+		un  []byte
+		pwd []byte
+		err error
+	)
+
+	if o, ok = req.Options.Get(socks6.OptAuthData); !ok || !c.allowAuthMethod(authMethodUnPwd) {
+		if !c.acceptBare() {
+			return ErrSocks6AuthFailed
+		}
+
+		return nil
+	}
+
+	c.method = socks6.MethodUnPwd
+	if un, pwd, err = socks6.ParseUnPwdAuthData(o); err != nil {
+		return err
+	}
+
+	return c.authenticate(string(un), string(pwd))
+}
+
+// exchange6 performs the operation of the request, only NOOP and CONNECT are
+// supported. The initial data is sent to the remote host before the replay so
+// it can be carried by the SYN if TCP Fast Open is asked on the proxy-remote leg
+func (c *conn) exchange6() error {
+	var (
+		req      = c.s6.req
+		initData []byte
+		opts     socks6.Options
+		err      error
+	)
+
+	if c.s6.teardown {
+		defer c.server.socks6Sessions().remove(c.s6.session)
+	}
+
+	if o, ok := req.Options.Get(socks6.OptAuthMethodAdvert); ok {
+		if n, _, err := socks6.ParseAuthMethodAdvertOption(o); err == nil && n > 0 {
+			initData = make([]byte, n)
+			if _, err = io.ReadFull(c.br, initData); err != nil {
+				return ErrSocks6ReadInitialData
+			}
+		}
+	}
+
+	switch req.Cmd {
+	case socks6.CmdNoop:
+		return c.writeOpReplay6(socks6.RepSucceeded, nil)
+	case socks6.CmdConnect:
+	default:
+		return c.writeOpReplay6(socks6.RepCmdNotSupported, nil)
+	}
+
+	c.dstHost = req.Addr.String()
+	if err = c.resolveDstAddr(); err != nil {
+		c.server.Log(err)
+		return c.writeOpReplay6(socks6.RepATypNotSupported, nil)
+	}
+
+	for _, o := range req.Options {
+		if o.Kind == socks6.OptStack && socks6.IsTfoOption(o) && tcpFastOpenSupported {
+			c.fastOpen = true
+			opts = append(opts, o)
+		}
+	}
+
+	if err = c.prepareExchange(); err != nil {
+		c.server.Log(err)
+		return c.writeOpReplay6(prepareExchangeRep(err), nil)
+	}
+
+	if len(initData) > 0 {
+		if _, err = c.dstConn.Write(initData); err != nil {
+			c.server.Log(ErrSocks6WriteInitialData)
+			return c.writeOpReplay6(socks6.RepGeneralServerFailure, nil)
+		}
+	}
+
+	if err = c.writeOpReplay6(socks6.RepSucceeded, opts); err != nil {
+		return err
+	}
+
+	return c.relay()
+}
+
+func (c *conn) writeAuthReplay6(rep *socks6.AuthReply) error {
+	var (
+		b   []byte
+		err error
+	)
+
+	if b, err = rep.Bytes(); err != nil {
+		return err
+	}
+
+	if _, err = c.netConn.Write(b); err != nil {
+		return ErrSocks6WriteReplay
+	}
+
+	return nil
+}
+
+func (c *conn) writeOpReplay6(code byte, opts socks6.Options) error {
+	var (
+		rep = &socks6.OpReply{Code: code, Options: opts}
+		b   []byte
+		err error
+	)
+
+	if c.dstConn != nil {
+		rep.Addr = socks6.FromTCPAddr(tcpAddrOf(c.dstConn.LocalAddr()))
+	}
+
+	if b, err = rep.Bytes(); err != nil {
+		return err
+	}
+
+	if _, err = c.netConn.Write(b); err != nil {
+		return ErrSocks6WriteReplay
+	}
+
+	if code != socks6.RepSucceeded {
+		c.close()
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"io"
+	"net"
+	"socks5/client"
+	"socks6"
+	"testing"
+	"time"
+)
+
+func listenEcho(t *testing.T) net.Listener {
+	var (
+		l   net.Listener
+		err error
+	)
+
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	return l
+}
+
+func listenServer(t *testing.T, cfg *Config) net.Listener {
+	var (
+		l   net.Listener
+		err error
+	)
+
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the destinations of tests are on loopback
+	cfg.DstGuardAllow = append(cfg.DstGuardAllow, "127.0.0.0/8")
+
+	go (&Server{Cfg: cfg, StartTime: time.Now()}).Serve(l)
+	return l
+}
+
+func TestSocks6Connect(t *testing.T) {
+	var (
+		echo = listenEcho(t)
+		srv  = listenServer(t, &Config{UsrPwdPairs: map[string]string{"Usr1": "Pwd1"}})
+		d    *client.Socks6Dialer
+		c    *client.Socks6Conn
+		buf  = make([]byte, 5)
+		err  error
+	)
+
+	defer echo.Close()
+	defer srv.Close()
+
+	d = &client.Socks6Dialer{
+		SrvAddr:        srv.Addr().String(),
+		Un:             []byte("Usr1"),
+		Pwd:            []byte("Pwd1"),
+		FastOpen:       true,
+		RequestSession: true,
+		TokenWindow:    2,
+	}
+
+	if c, err = d.Dial(echo.Addr().String(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("Failed to receive initial data", err)
+	}
+
+	if tcpFastOpenSupported && !c.Rep.Options.Has(socks6.OptStack) {
+		t.Fatal("TCP Fast Open wasn't applied")
+	}
+
+	c.Close()
+
+	if d.SessionId() == nil {
+		t.Fatal("Failed to establish session")
+	}
+
+	// the first request in the session asks for tokens, the next two spend them
+	for i := 0; i < 3; i++ {
+		if c, err = d.Dial(echo.Addr().String(), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		c.Write([]byte("world"))
+		if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "world" {
+			t.Fatal("Failed to exchange data", err)
+		}
+
+		c.Close()
+	}
+
+	if err = d.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.RequestSession = false
+	d.Pwd = []byte("Pwd2")
+	if _, err = d.Dial(echo.Addr().String(), nil); err != client.ErrSocks6AuthFailed {
+		t.Fatal("Expected auth failure, got", err)
+	}
+}
+
+func TestSocks6InvalidSession(t *testing.T) {
+	var (
+		srv = listenServer(t, &Config{})
+		nc  net.Conn
+		req []byte
+		rep *socks6.AuthReply
+		err error
+	)
+
+	defer srv.Close()
+
+	if nc, err = net.Dial("tcp", srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	req, _ = (&socks6.Request{
+		Cmd:     socks6.CmdNoop,
+		Addr:    socks6.FromTCPAddr(nil),
+		Options: socks6.Options{socks6.SessionIdOption([]byte("0123456789abcdef"))},
+	}).Bytes()
+	nc.Write(req)
+
+	if rep, err = socks6.ReadAuthReply(nc); err != nil {
+		t.Fatal(err)
+	}
+
+	if rep.Type != socks6.AuthFailed || !rep.Options.Has(socks6.OptSessionInvalid) {
+		t.Fatal("Expected invalid session")
+	}
+}
+
+func TestSocks6SessionLimit(t *testing.T) {
+	var (
+		ss  = newSocks6Sessions()
+		s   *socks6Session
+		err error
+	)
+
+	for i := 0; i < socks6MaxSessions; i++ {
+		if s, err = ss.create(authMethodBare, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = ss.create(authMethodBare, nil); err != ErrSocks6TooManySessions {
+		t.Fatal("Expected too many sessions, got", err)
+	}
+
+	s.expire = time.Now().Add(-time.Second)
+	if _, err = ss.create(authMethodBare, nil); err != nil {
+		t.Fatal("Expected the expired session to be purged", err)
+	}
+}
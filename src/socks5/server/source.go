@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	ErrSourceDenied      = errors.New("Source: client address is not allowed.")
+	ErrSourceInvalidCidr = errors.New("Source: invalid CIDR in ClientAllow, ClientDeny or IpIdentities.")
+)
+
+// ipIdentity maps the clients in a network to an identity
+type ipIdentity struct {
+	net      *net.IPNet
+	identity *Identity
+}
+
+func parseCidrs(cidrs []string) ([]*net.IPNet, error) {
+	var (
+		nets []*net.IPNet
+	)
+
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, ErrSourceInvalidCidr
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func (c *Config) compileSources() error {
+	var (
+		n   *net.IPNet
+		err error
+	)
+
+	if c.clientAllow, err = parseCidrs(c.ClientAllow); err != nil {
+		return err
+	}
+
+	if c.clientDeny, err = parseCidrs(c.ClientDeny); err != nil {
+		return err
+	}
+
+	c.ipIdentities = nil
+	for cidr, name := range c.IpIdentities {
+		if _, n, err = net.ParseCIDR(cidr); err != nil {
+			return ErrSourceInvalidCidr
+		}
+
+		c.ipIdentities = append(c.ipIdentities, &ipIdentity{n, &Identity{Name: name}})
+	}
+
+	return nil
+}
+
+// allowClient reports whether the client at ip can connect, ClientDeny is
+// checked first, then ClientAllow if it's not empty
+func (c *Config) allowClient(ip net.IP) bool {
+	if c.compile() != nil {
+		return false
+	}
+
+	if containsIP(c.clientDeny, ip) {
+		return false
+	}
+
+	return len(c.clientAllow) == 0 || containsIP(c.clientAllow, ip)
+}
+
+// ipIdentity returns the identity of the client at ip by the most specific
+// network of IpIdentities, nil if there isn't one
+func (c *Config) ipIdentity(ip net.IP) *Identity {
+	var (
+		best *ipIdentity
+	)
+
+	if c.compile() != nil {
+		return nil
+	}
+
+	for _, ii := range c.ipIdentities {
+		if !ii.net.Contains(ip) {
+			continue
+		}
+
+		if best == nil || maskOnes(ii.net) > maskOnes(best.net) {
+			best = ii
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	return best.identity
+}
+
+func maskOnes(n *net.IPNet) int {
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteIP returns the IP of the address, nil if it's not an IP address
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return net.ParseIP(host)
+	}
+
+	return nil
+}
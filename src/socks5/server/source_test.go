@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllowClient(t *testing.T) {
+	var (
+		cfg = &Config{
+			ClientAllow: []string{"10.0.0.0/8", "::1/128"},
+			ClientDeny:  []string{"10.1.0.0/16"},
+		}
+		cases = map[string]bool{
+			"10.0.0.1":    true,
+			"10.1.0.1":    false,
+			"192.168.0.1": false,
+			"::1":         true,
+		}
+	)
+
+	for ip, expected := range cases {
+		if cfg.allowClient(net.ParseIP(ip)) != expected {
+			t.Fatal("Unexpected result of", ip)
+		}
+	}
+
+	if !(&Config{ClientDeny: []string{"10.1.0.0/16"}}).allowClient(net.ParseIP("192.168.0.1")) {
+		t.Fatal("Expected the clients to be allowed if ClientAllow is empty")
+	}
+
+	if (&Config{ClientAllow: []string{"10.0.0.0/33"}}).allowClient(net.ParseIP("10.0.0.1")) {
+		t.Fatal("Expected the clients to be refused if the CIDRs are invalid")
+	}
+}
+
+func TestIpIdentity(t *testing.T) {
+	var (
+		cfg = &Config{IpIdentities: map[string]string{
+			"10.0.0.0/8":  "office",
+			"10.1.0.0/16": "lab",
+			"10.1.2.3/32": "printer",
+		}}
+		cases = map[string]string{
+			"10.0.0.1": "office",
+			"10.1.0.1": "lab",
+			"10.1.2.3": "printer",
+		}
+	)
+
+	for ip, name := range cases {
+		if id := cfg.ipIdentity(net.ParseIP(ip)); id == nil || id.Name != name {
+			t.Fatal("Unexpected identity of", ip, id)
+		}
+	}
+
+	if id := cfg.ipIdentity(net.ParseIP("192.168.0.1")); id != nil {
+		t.Fatal("Expected no identity", id)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"syscall"
+)
+
+const (
+	tcpFastOpenSupported = true
+
+	// TCP_FASTOPEN_CONNECT of linux/tcp.h, it's missing in syscall
+	tcpFastOpenConnect = 30
+)
+
+// fastOpenControl makes the dialer put the first written data into the SYN
+func fastOpenControl(network string, address string, rc syscall.RawConn) error {
+	var (
+		err  error
+		serr error
+	)
+
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"syscall"
+)
+
+const (
+	tcpFastOpenSupported = false
+)
+
+func fastOpenControl(network string, address string, rc syscall.RawConn) error {
+	return nil
+}
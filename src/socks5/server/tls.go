@@ -0,0 +1,286 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	tlsClientAuthNone    = ""
+	tlsClientAuthVerify  = "verify"
+	tlsClientAuthRequire = "require"
+
+	tlsClientIdentityCn  = ""
+	tlsClientIdentitySan = "san"
+
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	ErrTlsNoCert            = errors.New("Tls: TlsCertFile and TlsKeyFile are required by UseTls.")
+	ErrTlsLoadCert          = errors.New("Tls: failed to load the certificate or the key.")
+	ErrTlsInvalidMinVersion = errors.New("Tls: TlsMinVersion should be one of \"\", \"1.0\", \"1.1\", \"1.2\" and \"1.3\".")
+	ErrTlsUnknownCipher     = errors.New("Tls: unknown cipher suite.")
+	ErrTlsInvalidClientAuth = errors.New("Tls: TlsClientAuth should be one of \"\", \"verify\" and \"require\".")
+	ErrTlsInvalidClientId   = errors.New("Tls: TlsClientIdentity should be \"\" or \"san\".")
+	ErrTlsNoClientCa        = errors.New("Tls: TlsClientCaFile is required by TlsClientAuth.")
+	ErrTlsLoadClientCa      = errors.New("Tls: failed to load TlsClientCaFile.")
+	ErrTlsHandshake         = errors.New("Tls: handshake failed.")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c *Config) checkTls() error {
+	if !c.UseTls {
+		return nil
+	}
+
+	if c.TlsCertFile == "" || c.TlsKeyFile == "" {
+		return ErrTlsNoCert
+	}
+
+	if _, ok := tlsVersions[c.TlsMinVersion]; c.TlsMinVersion != "" && !ok {
+		return ErrTlsInvalidMinVersion
+	}
+
+	if _, err := tlsCipherSuites(c.TlsCipherSuites); err != nil {
+		return err
+	}
+
+	switch c.TlsClientAuth {
+	case tlsClientAuthNone:
+	case tlsClientAuthVerify, tlsClientAuthRequire:
+		if c.TlsClientCaFile == "" {
+			return ErrTlsNoClientCa
+		}
+	default:
+		return ErrTlsInvalidClientAuth
+	}
+
+	switch c.TlsClientIdentity {
+	case tlsClientIdentityCn, tlsClientIdentitySan:
+	default:
+		return ErrTlsInvalidClientId
+	}
+
+	return nil
+}
+
+// tlsCipherSuites maps the names like "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+// to their ids, the insecure ones are not accepted
+func tlsCipherSuites(names []string) ([]uint16, error) {
+	var (
+		ids []uint16
+	)
+
+next:
+	for _, name := range names {
+		for _, cs := range tls.CipherSuites() {
+			if cs.Name == name {
+				ids = append(ids, cs.ID)
+				continue next
+			}
+		}
+
+		return nil, ErrTlsUnknownCipher
+	}
+
+	return ids, nil
+}
+
+// tlsConfig returns the config of the TLS listener, the certificate is loaded
+// here and reloaded when its files are changed
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	var (
+		r   = &certReloader{certFile: c.TlsCertFile, keyFile: c.TlsKeyFile}
+		tc  *tls.Config
+		err error
+	)
+
+	if err = r.reload(); err != nil {
+		return nil, err
+	}
+
+	tc = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+	}
+
+	if c.TlsMinVersion != "" {
+		tc.MinVersion = tlsVersions[c.TlsMinVersion]
+	}
+
+	if tc.CipherSuites, err = tlsCipherSuites(c.TlsCipherSuites); err != nil {
+		return nil, err
+	}
+
+	if c.TlsClientAuth != tlsClientAuthNone {
+		if tc.ClientCAs, err = loadCertPool(c.TlsClientCaFile); err != nil {
+			return nil, err
+		}
+
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.TlsClientAuth == tlsClientAuthRequire {
+			tc.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tc, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	var (
+		pool = x509.NewCertPool()
+		fc   []byte
+		err  error
+	)
+
+	if fc, err = ioutil.ReadFile(file); err != nil {
+		return nil, ErrTlsLoadClientCa
+	}
+
+	if !pool.AppendCertsFromPEM(fc) {
+		return nil, ErrTlsLoadClientCa
+	}
+
+	return pool, nil
+}
+
+// certIdentity returns the identity of the verified client certificate, nil
+// if there isn't one
+func (c *Config) certIdentity(cert *x509.Certificate) *Identity {
+	var (
+		name string
+	)
+
+	switch c.TlsClientIdentity {
+	case tlsClientIdentityCn:
+		name = cert.Subject.CommonName
+	case tlsClientIdentitySan:
+		switch {
+		case len(cert.DNSNames) > 0:
+			name = cert.DNSNames[0]
+		case len(cert.EmailAddresses) > 0:
+			name = cert.EmailAddresses[0]
+		case len(cert.URIs) > 0:
+			name = cert.URIs[0].String()
+		}
+	}
+
+	if name == "" {
+		return nil
+	}
+
+	return &Identity{Name: name}
+}
+
+// handshakeTls completes the handshake of a TLS client before negotiating, the
+// identity of its verified certificate overrides the one mapped from its address
+func (c *conn) handshakeTls() error {
+	var (
+		tc *tls.Conn
+		cs tls.ConnectionState
+		ok bool
+	)
+
+	if tc, ok = c.netConn.(*tls.Conn); !ok {
+		return nil
+	}
+
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return ErrTlsHandshake
+	}
+
+	tc.SetDeadline(time.Time{})
+
+	if cs = tc.ConnectionState(); len(cs.VerifiedChains) > 0 {
+		if identity := c.server.Cfg.certIdentity(cs.VerifiedChains[0][0]); identity != nil {
+			c.bareIdentity = identity
+		}
+	}
+
+	return nil
+}
+
+// certReloader reloads the certificate if the modification time of its files
+// is changed, the old certificate is kept if the new one cannot be loaded
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	var (
+		ci  os.FileInfo
+		ki  os.FileInfo
+		err error
+	)
+
+	if ci, err = os.Stat(r.certFile); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if ki, err = os.Stat(r.keyFile); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return ci.ModTime(), ki.ModTime(), nil
+}
+
+// reload loads the certificate if its files are changed, the caller should
+// not hold r.mu
+func (r *certReloader) reload() error {
+	var (
+		certMod time.Time
+		keyMod  time.Time
+		cert    tls.Certificate
+		err     error
+	)
+
+	if certMod, keyMod, err = r.modTimes(); err != nil {
+		return ErrTlsLoadCert
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cert != nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return nil
+	}
+
+	if cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile); err != nil {
+		return ErrTlsLoadCert
+	}
+
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := r.reload(); err != nil {
+		// the files may be in the middle of being replaced
+		log.Println(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.cert, nil
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate of cn and its key to dir
+func writeTestCert(t *testing.T, dir string, cn string) (string, string) {
+	var (
+		key      *ecdsa.PrivateKey
+		der      []byte
+		keyDer   []byte
+		certFile = filepath.Join(dir, "cert.pem")
+		keyFile  = filepath.Join(dir, "key.pem")
+		err      error
+	)
+
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	if der, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if keyDer, err = x509.MarshalECPrivateKey(key); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestTlsCheck(t *testing.T) {
+	var (
+		cases = map[*Config]error{
+			{UseTls: true}: ErrTlsNoCert,
+			{UseTls: true, TlsCertFile: "c", TlsKeyFile: "k", TlsMinVersion: "1.4"}:                                  ErrTlsInvalidMinVersion,
+			{UseTls: true, TlsCertFile: "c", TlsKeyFile: "k", TlsCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}: ErrTlsUnknownCipher,
+			{UseTls: true, TlsCertFile: "c", TlsKeyFile: "k", TlsMinVersion: "1.3"}:                                  nil,
+		}
+	)
+
+	for cfg, expected := range cases {
+		if err := cfg.checkTls(); err != expected {
+			t.Fatal("Unexpected result", err, expected)
+		}
+	}
+}
+
+func TestTlsListener(t *testing.T) {
+	var (
+		dir string
+		cfg *Config
+		tc  *tls.Config
+		err error
+	)
+
+	if dir, err = ioutil.TempDir("", "cola"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cfg = &Config{UseTls: true, TlsMinVersion: "1.2"}
+	cfg.TlsCertFile, cfg.TlsKeyFile = writeTestCert(t, dir, "old.example")
+	if tc, err = cfg.tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	go (&Server{Cfg: cfg, StartTime: time.Now()}).Serve(l)
+
+	handshake := func() string {
+		nc, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer nc.Close()
+
+		buf := make([]byte, 2)
+		nc.Write([]byte{version5, 1, authMethodBare})
+		if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != authMethodBare {
+			t.Fatal("Unexpected negotiation over TLS", buf, err)
+		}
+
+		return nc.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if cn := handshake(); cn != "old.example" {
+		t.Fatal("Unexpected certificate", cn)
+	}
+
+	writeTestCert(t, dir, "new.example")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cfg.TlsCertFile, later, later)
+
+	if cn := handshake(); cn != "new.example" {
+		t.Fatal("Expected the certificate to be reloaded", cn)
+	}
+}
+
+func TestTlsClientCert(t *testing.T) {
+	var (
+		dir      string
+		cfg      *Config
+		tc       *tls.Config
+		cert     tls.Certificate
+		l        net.Listener
+		identity = make(chan *Identity, 1)
+		err      error
+	)
+
+	if dir, err = ioutil.TempDir("", "cola"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cfg = &Config{UseTls: true, TlsClientAuth: tlsClientAuthRequire, AuthMethods: []uint8{authMethodUnPwd}}
+	cfg.TlsCertFile, cfg.TlsKeyFile = writeTestCert(t, dir, "alice")
+	cfg.TlsClientCaFile = cfg.TlsCertFile
+	if err = cfg.checkTls(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tc, err = cfg.tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cert, err = tls.LoadX509KeyPair(cfg.TlsCertFile, cfg.TlsKeyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err = tls.Listen("tcp", "127.0.0.1:0", tc); err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			c, _ := (&Server{Cfg: cfg}).NewConn(nc)
+			if err = c.handshakeTls(); err != nil {
+				identity <- nil
+			} else {
+				identity <- c.bareIdentity
+				c.negotiate()
+			}
+
+			nc.Close()
+		}
+	}()
+
+	nc, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nc.Close()
+
+	buf := make([]byte, 2)
+	nc.Write([]byte{version5, 1, authMethodBare})
+	if _, err = io.ReadFull(nc, buf); err != nil || buf[1] != authMethodBare {
+		t.Fatal("Expected method 0 for the client certificate", buf, err)
+	}
+
+	if id := <-identity; id == nil || id.Name != "alice" {
+		t.Fatal("Unexpected identity", id)
+	}
+
+	// the handshake fails without a certificate
+	nc2, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		nc2.Read(buf)
+		nc2.Close()
+	}
+
+	if id := <-identity; id != nil {
+		t.Fatal("Expected the client without certificate to be refused", id)
+	}
+}
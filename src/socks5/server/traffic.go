@@ -0,0 +1,427 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	trafficDayLayout   = "2006-01-02"
+	trafficMonthLayout = "2006-01"
+
+	// the bytes relayed by a connection are added to the usage in batches
+	trafficFlushBytes = 64 << 10
+)
+
+var (
+	ErrTrafficQuotaExceeded = errors.New("Traffic: quota is used up.")
+	ErrTrafficReadFile      = errors.New("Traffic: failed to read TrafficFile.")
+	ErrTrafficParseFile     = errors.New("Traffic: invalid JSON format of TrafficFile.")
+	ErrTrafficWriteFile     = errors.New("Traffic: failed to write TrafficFile.")
+	ErrTrafficApiExposed    = errors.New("Traffic: TrafficApiAddr should be a loopback address unless TrafficApiToken is set.")
+)
+
+// Traffic is the bytes sent by a user to destinations and the bytes received from them
+type Traffic struct {
+	Up   int64 `json:"Up"`
+	Down int64 `json:"Down"`
+}
+
+func (t *Traffic) add(up int64, down int64) {
+	t.Up += up
+	t.Down += down
+}
+
+// TrafficUsage is the traffic of a user in total, in the current day and in the
+// current month, Day and Month are like "2006-01-02" and "2006-01" in local time
+type TrafficUsage struct {
+	Total     Traffic `json:"Total"`
+	Day       string  `json:"Day"`
+	DayUsed   Traffic `json:"DayUsed"`
+	Month     string  `json:"Month"`
+	MonthUsed Traffic `json:"MonthUsed"`
+}
+
+// rollover resets the counters of the past day and month
+func (u *TrafficUsage) rollover(now time.Time) {
+	if day := now.Format(trafficDayLayout); u.Day != day {
+		u.Day, u.DayUsed = day, Traffic{}
+	}
+
+	if month := now.Format(trafficMonthLayout); u.Month != month {
+		u.Month, u.MonthUsed = month, Traffic{}
+	}
+}
+
+// TrafficQuota is the bytes, up and down together, a user can transfer in a day
+// and in a month, 0 means unlimited
+type TrafficQuota struct {
+	Daily   int64 `json:"Daily"`
+	Monthly int64 `json:"Monthly"`
+}
+
+// trafficQuota returns the quota of the user, UserTrafficQuotas overrides TrafficQuota
+func (c *Config) trafficQuota(user string) *TrafficQuota {
+	if q, ok := c.UserTrafficQuotas[user]; ok {
+		return q
+	}
+
+	return c.TrafficQuota
+}
+
+func (c *Config) trafficSaveInterval() time.Duration {
+	if c.TrafficSaveInterval == 0 {
+		return time.Minute
+	}
+
+	return time.Duration(c.TrafficSaveInterval) * time.Second
+}
+
+// usage returns the usage of the user, the caller should hold s.trafficMu
+func (s *Server) usage(user string) *TrafficUsage {
+	if s.traffic == nil {
+		s.traffic = make(map[string]*TrafficUsage)
+	}
+
+	u, ok := s.traffic[user]
+	if !ok {
+		u = &TrafficUsage{}
+		s.traffic[user] = u
+	}
+
+	u.rollover(time.Now())
+	return u
+}
+
+func (s *Server) addTraffic(user string, up int64, down int64) {
+	s.trafficMu.Lock()
+	defer s.trafficMu.Unlock()
+
+	u := s.usage(user)
+	u.Total.add(up, down)
+	u.DayUsed.add(up, down)
+	u.MonthUsed.add(up, down)
+	s.trafficDirty = true
+}
+
+// Traffic returns the total traffic of the user, anonymous users are counted under ""
+func (s *Server) Traffic(user string) Traffic {
+	return s.TrafficUsage(user).Total
+}
+
+// TrafficUsage returns the usage of the user
+func (s *Server) TrafficUsage(user string) TrafficUsage {
+	s.trafficMu.Lock()
+	defer s.trafficMu.Unlock()
+
+	if _, ok := s.traffic[user]; !ok {
+		return TrafficUsage{}
+	}
+
+	return *s.usage(user)
+}
+
+// TrafficUsages returns the usages of all users
+func (s *Server) TrafficUsages() map[string]TrafficUsage {
+	s.trafficMu.Lock()
+	defer s.trafficMu.Unlock()
+
+	m := make(map[string]TrafficUsage, len(s.traffic))
+	for user := range s.traffic {
+		m[user] = *s.usage(user)
+	}
+
+	return m
+}
+
+// checkTrafficQuota returns ErrTrafficQuotaExceeded if the user has used up
+// the daily or the monthly quota
+func (s *Server) checkTrafficQuota(user string) error {
+	var (
+		q = s.Cfg.trafficQuota(user)
+		u TrafficUsage
+	)
+
+	if q == nil || (q.Daily <= 0 && q.Monthly <= 0) {
+		return nil
+	}
+
+	u = s.TrafficUsage(user)
+	if q.Daily > 0 && u.DayUsed.Up+u.DayUsed.Down >= q.Daily {
+		return ErrTrafficQuotaExceeded
+	}
+
+	if q.Monthly > 0 && u.MonthUsed.Up+u.MonthUsed.Down >= q.Monthly {
+		return ErrTrafficQuotaExceeded
+	}
+
+	return nil
+}
+
+// startTraffic loads the usages from TrafficFile and saves them periodically,
+// it also serves TrafficHandler on TrafficApiAddr if it's not empty, with
+// DnsCacheHandler on "/dns-cache"
+func (s *Server) startTraffic() {
+	s.trafficOnce.Do(func() {
+		if s.Cfg.TrafficFile != "" {
+			if err := s.loadTraffic(s.Cfg.TrafficFile); err != nil {
+				s.Log(err)
+			}
+
+			go func() {
+				for range time.Tick(s.Cfg.trafficSaveInterval()) {
+					if err := s.SaveTraffic(); err != nil {
+						s.Log(err)
+					}
+				}
+			}()
+		}
+
+		if s.Cfg.TrafficApiAddr != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/", s.TrafficHandler())
+			mux.Handle("/dns-cache", s.DnsCacheHandler())
+
+			go func() {
+				s.Log(http.ListenAndServe(s.Cfg.TrafficApiAddr, s.Cfg.trafficApiAuth(mux)))
+			}()
+		}
+	})
+}
+
+// checkTrafficApi refuses to serve the usages on a non-loopback address without a token
+func (c *Config) checkTrafficApi() error {
+	var (
+		host string
+		err  error
+	)
+
+	if c.TrafficApiAddr == "" || c.TrafficApiToken != "" {
+		return nil
+	}
+
+	if host, _, err = net.SplitHostPort(c.TrafficApiAddr); err != nil {
+		return ErrTrafficApiExposed
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return ErrTrafficApiExposed
+	}
+
+	return nil
+}
+
+// trafficApiAuth requires TrafficApiToken as the bearer token if it's set
+func (c *Config) trafficApiAuth(h http.Handler) http.Handler {
+	if c.TrafficApiToken == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+c.TrafficApiToken)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loadTraffic reads the usages saved by SaveTraffic, it's fine if the file doesn't exist
+func (s *Server) loadTraffic(file string) error {
+	var (
+		fc  []byte
+		m   map[string]*TrafficUsage
+		err error
+	)
+
+	if fc, err = ioutil.ReadFile(file); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return ErrTrafficReadFile
+	}
+
+	if err = json.Unmarshal(fc, &m); err != nil {
+		return ErrTrafficParseFile
+	}
+
+	// the null entries are dropped
+	for user, u := range m {
+		if u == nil {
+			delete(m, user)
+		}
+	}
+
+	s.trafficMu.Lock()
+	s.traffic = m
+	s.trafficMu.Unlock()
+
+	return nil
+}
+
+// SaveTraffic writes the usages to TrafficFile if they were changed, the pending
+// bytes of the live relays are added first. the file is replaced atomically so a
+// crash cannot leave it half written, and it's retried next time if it fails
+func (s *Server) SaveTraffic() error {
+	var (
+		file = s.Cfg.TrafficFile
+		fc   []byte
+		err  error
+	)
+
+	if file == "" {
+		return nil
+	}
+
+	s.flushTrafficWriters()
+
+	s.trafficMu.Lock()
+	if !s.trafficDirty {
+		s.trafficMu.Unlock()
+		return nil
+	}
+
+	// the usages changed during writing mark it dirty again
+	fc, err = json.MarshalIndent(s.traffic, "", "  ")
+	s.trafficDirty = false
+	s.trafficMu.Unlock()
+
+	if err == nil {
+		if err = ioutil.WriteFile(file+".tmp", fc, os.FileMode(0600)); err == nil {
+			err = os.Rename(file+".tmp", file)
+		}
+
+		if err != nil {
+			err = ErrTrafficWriteFile
+		}
+	}
+
+	if err != nil {
+		s.trafficMu.Lock()
+		s.trafficDirty = true
+		s.trafficMu.Unlock()
+	}
+
+	return err
+}
+
+// TrafficHandler serves the usages as JSON, the usage of one user is returned
+// if the "user" query parameter is given
+func (s *Server) TrafficHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			v interface{}
+		)
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if user, ok := r.URL.Query()["user"]; ok {
+			v = s.TrafficUsage(user[0])
+		} else {
+			v = s.TrafficUsages()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+}
+
+// trafficWriter adds the bytes written to w to the traffic of the user, they are
+// added once trafficFlushBytes are pending and the rest is added by flush
+type trafficWriter struct {
+	w       io.Writer
+	s       *Server
+	user    string
+	up      bool
+	pending int64
+}
+
+func (tw *trafficWriter) Write(b []byte) (int, error) {
+	n, err := tw.w.Write(b)
+
+	if atomic.AddInt64(&tw.pending, int64(n)) >= trafficFlushBytes {
+		tw.flush()
+	}
+
+	return n, err
+}
+
+func (tw *trafficWriter) flush() {
+	n := atomic.SwapInt64(&tw.pending, 0)
+	if n == 0 {
+		return
+	}
+
+	if tw.up {
+		tw.s.addTraffic(tw.user, n, 0)
+	} else {
+		tw.s.addTraffic(tw.user, 0, n)
+	}
+}
+
+// relayWriters wraps the writers towards the destination and the client, the
+// bytes are limited by the rate limit and counted as the traffic of the identity.
+// the pending bytes are flushed when the conn is closed
+func (c *conn) relayWriters(dst io.Writer, clt io.Writer) (io.Writer, io.Writer) {
+	var (
+		name = c.userName()
+		up   *trafficWriter
+		down *trafficWriter
+	)
+
+	dst, clt = c.limitWriters(dst, clt)
+	up, down = &trafficWriter{w: dst, s: c.server, user: name, up: true}, &trafficWriter{w: clt, s: c.server, user: name}
+	c.trafficWriters = append(c.trafficWriters, up, down)
+
+	c.server.trafficMu.Lock()
+	if c.server.trafficWriters == nil {
+		c.server.trafficWriters = make(map[*trafficWriter]bool)
+	}
+
+	c.server.trafficWriters[up], c.server.trafficWriters[down] = true, true
+	c.server.trafficMu.Unlock()
+
+	return up, down
+}
+
+func (c *conn) flushTraffic() {
+	c.server.trafficMu.Lock()
+	for _, tw := range c.trafficWriters {
+		delete(c.server.trafficWriters, tw)
+	}
+	c.server.trafficMu.Unlock()
+
+	for _, tw := range c.trafficWriters {
+		tw.flush()
+	}
+}
+
+// flushTrafficWriters adds the pending bytes of the live relays
+func (s *Server) flushTrafficWriters() {
+	var (
+		tws []*trafficWriter
+	)
+
+	s.trafficMu.Lock()
+	for tw := range s.trafficWriters {
+		tws = append(tws, tw)
+	}
+	s.trafficMu.Unlock()
+
+	for _, tw := range tws {
+		tw.flush()
+	}
+}
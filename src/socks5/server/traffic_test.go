@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrafficQuota(t *testing.T) {
+	var (
+		s = &Server{Cfg: &Config{
+			TrafficQuota:      &TrafficQuota{Daily: 100},
+			UserTrafficQuotas: map[string]*TrafficQuota{"bob": {Monthly: 1000}},
+		}}
+	)
+
+	s.addTraffic("alice", 60, 30)
+	if err := s.checkTrafficQuota("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.addTraffic("alice", 0, 10)
+	if err := s.checkTrafficQuota("alice"); err != ErrTrafficQuotaExceeded {
+		t.Fatal("Expected the quota to be used up", err)
+	}
+
+	s.addTraffic("bob", 500, 400)
+	if err := s.checkTrafficQuota("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr := s.Traffic("alice"); tr.Up != 60 || tr.Down != 40 {
+		t.Fatal("Unexpected traffic", tr)
+	}
+}
+
+func TestTrafficRollover(t *testing.T) {
+	var (
+		u   = &TrafficUsage{Total: Traffic{Up: 10}, Day: "2000-01-01", DayUsed: Traffic{Up: 10}, Month: "2000-01", MonthUsed: Traffic{Up: 10}}
+		now = time.Date(2000, 1, 2, 0, 0, 0, 0, time.Local)
+	)
+
+	u.rollover(now)
+	if u.DayUsed.Up != 0 || u.MonthUsed.Up != 10 || u.Total.Up != 10 {
+		t.Fatal("Unexpected usage after a day", u)
+	}
+
+	u.rollover(now.AddDate(0, 1, 0))
+	if u.MonthUsed.Up != 0 || u.Total.Up != 10 {
+		t.Fatal("Unexpected usage after a month", u)
+	}
+}
+
+func TestTrafficPersist(t *testing.T) {
+	var (
+		dir string
+		s   *Server
+		w   = httptest.NewRecorder()
+		u   TrafficUsage
+		err error
+	)
+
+	if dir, err = ioutil.TempDir("", "cola"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	s = &Server{Cfg: &Config{TrafficFile: filepath.Join(dir, "traffic.json")}}
+	s.addTraffic("alice", 1, 2)
+	if err = s.SaveTraffic(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = &Server{Cfg: s.Cfg}
+	if err = s.loadTraffic(s.Cfg.TrafficFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr := s.Traffic("alice"); tr.Up != 1 || tr.Down != 2 {
+		t.Fatal("Unexpected traffic after loading", tr)
+	}
+
+	s.TrafficHandler().ServeHTTP(w, httptest.NewRequest("GET", "/?user=alice", nil))
+	if err = json.Unmarshal(w.Body.Bytes(), &u); err != nil || u.Total.Down != 2 {
+		t.Fatal("Unexpected response", w.Body.String(), err)
+	}
+}
+
+func TestTrafficWriterFlush(t *testing.T) {
+	var (
+		s      = &Server{Cfg: &Config{}}
+		nc, pc = net.Pipe()
+		c      = &conn{server: s, netConn: nc}
+	)
+
+	defer pc.Close()
+
+	up, down := c.relayWriters(ioutil.Discard, ioutil.Discard)
+	up.Write(make([]byte, 100))
+	down.Write(make([]byte, trafficFlushBytes))
+
+	if tr := s.Traffic(""); tr.Up != 0 || tr.Down != trafficFlushBytes {
+		t.Fatal("Expected the bytes to be added in batches", tr)
+	}
+
+	c.close()
+	if tr := s.Traffic(""); tr.Up != 100 || tr.Down != trafficFlushBytes {
+		t.Fatal("Expected the pending bytes to be flushed on close", tr)
+	}
+}
+
+func TestTrafficLoadNull(t *testing.T) {
+	var (
+		dir  string
+		file string
+		s    = &Server{Cfg: &Config{}}
+		err  error
+	)
+
+	if dir, err = ioutil.TempDir("", "cola"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	file = filepath.Join(dir, "traffic.json")
+	ioutil.WriteFile(file, []byte(`{"alice": null, "bob": {"Total": {"Up": 1}}}`), 0600)
+	if err = s.loadTraffic(file); err != nil {
+		t.Fatal(err)
+	}
+
+	s.addTraffic("alice", 1, 0)
+	if s.Traffic("alice").Up != 1 || s.Traffic("bob").Up != 1 {
+		t.Fatal("Unexpected traffic", s.TrafficUsages())
+	}
+}
+
+func TestTrafficSaveRetry(t *testing.T) {
+	var (
+		dir    string
+		s      *Server
+		nc, pc = net.Pipe()
+		err    error
+	)
+
+	defer pc.Close()
+
+	if dir, err = ioutil.TempDir("", "cola"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// the directory of TrafficFile doesn't exist yet
+	s = &Server{Cfg: &Config{TrafficFile: filepath.Join(dir, "data", "traffic.json")}}
+	s.addTraffic("alice", 1, 0)
+	if err = s.SaveTraffic(); err != ErrTrafficWriteFile {
+		t.Fatal("Expected the write to fail", err)
+	}
+
+	// the pending bytes of a live relay are saved too
+	up, _ := (&conn{server: s, netConn: nc}).relayWriters(ioutil.Discard, ioutil.Discard)
+	up.Write(make([]byte, 10))
+
+	os.Mkdir(filepath.Join(dir, "data"), 0700)
+	if err = s.SaveTraffic(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = &Server{Cfg: s.Cfg}
+	if err = s.loadTraffic(s.Cfg.TrafficFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr := s.Traffic("alice"); tr.Up != 1 || s.Traffic("").Up != 10 {
+		t.Fatal("Expected the failed save to be retried", tr, s.Traffic(""))
+	}
+}
+
+func TestTrafficApi(t *testing.T) {
+	var (
+		cases = map[*Config]error{
+			{TrafficApiAddr: "127.0.0.1:1081"}:                          nil,
+			{TrafficApiAddr: "[::1]:1081"}:                              nil,
+			{TrafficApiAddr: "localhost:1081"}:                          nil,
+			{TrafficApiAddr: ":1081"}:                                   ErrTrafficApiExposed,
+			{TrafficApiAddr: "0.0.0.0:1081"}:                            ErrTrafficApiExposed,
+			{TrafficApiAddr: "0.0.0.0:1081", TrafficApiToken: "secret"}: nil,
+		}
+		cfg = &Config{TrafficApiToken: "secret"}
+		h   = cfg.trafficApiAuth(http.NotFoundHandler())
+	)
+
+	for c, expected := range cases {
+		if err := c.checkTrafficApi(); err != expected {
+			t.Fatal("Unexpected result of", c.TrafficApiAddr, err)
+		}
+	}
+
+	for auth, code := range map[string]int{"": http.StatusUnauthorized, "Bearer other": http.StatusUnauthorized, "Bearer secret": http.StatusNotFound} {
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", auth)
+		if h.ServeHTTP(w, r); w.Code != code {
+			t.Fatal("Unexpected status of", auth, w.Code)
+		}
+	}
+}
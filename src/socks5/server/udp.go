@@ -0,0 +1,387 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	udpMaxDatagramSize = 65535
+
+	// the max destinations remembered by an association, the replies are only
+	// accepted from them
+	udpMaxPeers = 1024
+)
+
+var (
+	ErrUdpListen            = errors.New("UdpAssociate: failed to create relay socket.")
+	ErrUdpHeaderTooShort    = errors.New("UdpAssociate: datagram is too short.")
+	ErrUdpHeaderInvalidRsv  = errors.New("UdpAssociate: invalid RSV.")
+	ErrUdpHeaderFragmented  = errors.New("UdpAssociate: fragmentation is not supported.")
+	ErrUdpHeaderInvalidATyp = errors.New("UdpAssociate: invalid address type.")
+	ErrUdpHeaderInvalidAddr = errors.New("UdpAssociate: invalid destination address.")
+	ErrUdpIdleTimeout       = errors.New("UdpAssociate: association is idle for too long.")
+	ErrUdpLifetimeExceeded  = errors.New("UdpAssociate: association exceeded its lifetime.")
+)
+
+// udpRelay is the state of one UDP association, cltConn faces the client and
+// rmtConn faces the destinations
+type udpRelay struct {
+	c        *conn
+	ctrl     net.Conn
+	cltConn  *net.UDPConn
+	rmtConn  *net.UDPConn
+	cltIPs   []net.IP
+	cltPort  int
+	mu       sync.Mutex
+	cltAddr  *net.UDPAddr
+	peers    map[string]int64
+	lastSeen int64
+	done     chan struct{}
+	once     sync.Once
+}
+
+// udpAssociate serves the UDP ASSOCIATE command, see https://tools.ietf.org/html/rfc1928#section-7
+//
+// the association lives as long as the controlling TCP connection, datagrams
+// come from sources other than the client are dropped
+func (c *conn) udpAssociate() error {
+	var (
+		err   error
+		r     *udpRelay
+		lAddr *net.TCPAddr
+		bAddr *net.UDPAddr
+		ok    bool
+	)
+
+	if err = c.resolveDst(); err != nil {
+		c.server.Log(err, c.dstHost)
+		return c.writeCmdReplay(repHostUnReachable)
+	}
+
+	if err = c.checkQuota(false); err != nil {
+		return c.writeCmdReplay(repNotAllowed)
+	}
+
+	r = &udpRelay{
+		c:     c,
+		ctrl:  c.netConn,
+		peers: make(map[string]int64),
+		done:  make(chan struct{}),
+	}
+
+	if lAddr, ok = c.netConn.LocalAddr().(*net.TCPAddr); !ok {
+		lAddr = &net.TCPAddr{}
+	}
+
+	if r.cltConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: lAddr.IP}); err != nil {
+		c.server.Log(ErrUdpListen, err)
+		return c.writeCmdReplay(repGeneralServerFailure)
+	}
+
+	if r.rmtConn, err = net.ListenUDP("udp", nil); err != nil {
+		r.cltConn.Close()
+		c.server.Log(ErrUdpListen, err)
+		return c.writeCmdReplay(repGeneralServerFailure)
+	}
+
+	if rAddr, ok := c.netConn.RemoteAddr().(*net.TCPAddr); ok {
+		r.cltIPs = []net.IP{rAddr.IP}
+	}
+
+	// the client may tell us the address it will send datagrams from, a domain
+	// may resolve to the addresses of both families
+	if c.dstAddr != nil && !c.dstAddr.IP.IsUnspecified() {
+		r.cltIPs = c.dstIPs
+	}
+
+	if c.dstAddr != nil {
+		r.cltPort = c.dstAddr.Port
+	}
+
+	bAddr = r.cltConn.LocalAddr().(*net.UDPAddr)
+	if err = c.writeCmdReplayAddr(repSucceeded, &net.TCPAddr{IP: bAddr.IP, Port: bAddr.Port}); err != nil {
+		r.close()
+		return err
+	}
+
+	r.touch()
+	return r.serve()
+}
+
+func (r *udpRelay) serve() error {
+	var (
+		cfg = r.c.server.Cfg
+		err error
+		t   *time.Ticker
+		end <-chan time.Time
+	)
+
+	go r.client2Remote()
+	go r.remote2Client()
+
+	// the association terminates when the controlling connection is closed
+	go func() {
+		io.Copy(ioutil.Discard, r.c.br)
+		r.close()
+	}()
+
+	if lt := cfg.udpLifetime(); lt > 0 {
+		end = time.After(lt)
+	}
+
+	t = time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return nil
+		case <-end:
+			err = ErrUdpLifetimeExceeded
+		case now := <-t.C:
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&r.lastSeen))) < cfg.udpIdleTimeout() {
+				continue
+			}
+
+			err = ErrUdpIdleTimeout
+		}
+
+		r.close()
+		return err
+	}
+}
+
+func (r *udpRelay) client2Remote() {
+	var (
+		buf  = make([]byte, udpMaxDatagramSize)
+		n    int
+		src  *net.UDPAddr
+		host string
+		port int
+		ip   net.IP
+		dst  *net.UDPAddr
+		data []byte
+		err  error
+	)
+
+	for {
+		if n, src, err = r.cltConn.ReadFromUDP(buf); err != nil {
+			r.close()
+			return
+		}
+
+		if !r.isClient(src) {
+			continue
+		}
+
+		if host, port, data, err = parseUdpHeader(buf[:n]); err != nil {
+			r.c.server.Log(err)
+			continue
+		}
+
+		if ip, err = r.c.lookupHost(host, port); err != nil {
+			r.c.server.Log(ErrUdpHeaderInvalidAddr, host)
+			continue
+		}
+
+		dst = &net.UDPAddr{IP: ip, Port: port}
+
+		if !r.c.server.Cfg.allowDst(r.c.userName(), host, dst.IP, dst.Port) {
+			r.c.server.Log(ErrAclDenied, host)
+			continue
+		}
+
+		if !r.c.server.Cfg.guardAllows(dst.IP) {
+			r.c.server.Log(ErrGuardBlocked, dst)
+			continue
+		}
+
+		if err = r.c.server.Cfg.checkLocalRoute(r.c.userName(), host, dst.IP, dst.Port); err != nil {
+			r.c.server.Log(err, host)
+			continue
+		}
+
+		r.addPeer(dst)
+
+		if ul := r.c.limiter(); ul != nil && ul.up != nil {
+			ul.up.wait(len(data))
+		}
+
+		if _, err = r.rmtConn.WriteToUDP(data, dst); err != nil {
+			r.c.server.Log(err)
+			continue
+		}
+
+		r.c.server.addTraffic(r.c.userName(), int64(len(data)), 0)
+		r.touch()
+	}
+}
+
+func (r *udpRelay) remote2Client() {
+	var (
+		buf    = make([]byte, udpMaxDatagramSize)
+		n      int
+		src    *net.UDPAddr
+		clt    *net.UDPAddr
+		header []byte
+		err    error
+		ok     bool
+	)
+
+	for {
+		if n, src, err = r.rmtConn.ReadFromUDP(buf); err != nil {
+			r.close()
+			return
+		}
+
+		r.mu.Lock()
+		_, ok = r.peers[src.String()]
+		clt = r.cltAddr
+		r.mu.Unlock()
+
+		// only the peers the client has sent datagrams to can reply
+		if !ok || clt == nil {
+			continue
+		}
+
+		if ul := r.c.limiter(); ul != nil && ul.down != nil {
+			ul.down.wait(n)
+		}
+
+		header = appendAddr([]byte{reqRsv, reqRsv, 0}, src.IP, src.Port)
+		if _, err = r.cltConn.WriteToUDP(append(header, buf[:n]...), clt); err != nil {
+			r.c.server.Log(err)
+			continue
+		}
+
+		r.c.server.addTraffic(r.c.userName(), 0, int64(n))
+		r.touch()
+	}
+}
+
+// isClient reports whether src is the client of the association, the first
+// valid datagram fixes the client address
+func (r *udpRelay) isClient(src *net.UDPAddr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cltAddr != nil {
+		return r.cltAddr.IP.Equal(src.IP) && r.cltAddr.Port == src.Port
+	}
+
+	if r.cltIPs != nil && !hasIP(r.cltIPs, src.IP) {
+		return false
+	}
+
+	if r.cltPort != 0 && r.cltPort != src.Port {
+		return false
+	}
+
+	r.cltAddr = src
+	return true
+}
+
+// addPeer remembers dst, the peers idle for udpIdleTimeout are forgotten once
+// udpMaxPeers are remembered and then the least recently used one if necessary
+func (r *udpRelay) addPeer(dst *net.UDPAddr) {
+	var (
+		now    = time.Now().UnixNano()
+		key    = dst.String()
+		oldest string
+	)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.peers[key]; !ok && len(r.peers) >= udpMaxPeers {
+		idle := now - int64(r.c.server.Cfg.udpIdleTimeout())
+		for k, t := range r.peers {
+			if t < idle {
+				delete(r.peers, k)
+			} else if oldest == "" || t < r.peers[oldest] {
+				oldest = k
+			}
+		}
+
+		if len(r.peers) >= udpMaxPeers {
+			delete(r.peers, oldest)
+		}
+	}
+
+	r.peers[key] = now
+}
+
+func (r *udpRelay) touch() {
+	atomic.StoreInt64(&r.lastSeen, time.Now().UnixNano())
+}
+
+func (r *udpRelay) close() {
+	r.once.Do(func() {
+		close(r.done)
+		r.cltConn.Close()
+		if r.rmtConn != nil {
+			r.rmtConn.Close()
+		}
+
+		r.ctrl.Close()
+	})
+}
+
+// parseUdpHeader parses the header of a datagram sent by the client, it returns
+// the requested host, port and the payload
+func parseUdpHeader(b []byte) (string, int, []byte, error) {
+	var (
+		host string
+		hLen int
+	)
+
+	if len(b) < 4 {
+		return "", 0, nil, ErrUdpHeaderTooShort
+	}
+
+	if b[0] != reqRsv || b[1] != reqRsv {
+		return "", 0, nil, ErrUdpHeaderInvalidRsv
+	}
+
+	if b[2] != 0 {
+		return "", 0, nil, ErrUdpHeaderFragmented
+	}
+
+	switch b[3] {
+	case aTypIpv4:
+		hLen = 4 + net.IPv4len + 2
+		if len(b) < hLen {
+			return "", 0, nil, ErrUdpHeaderTooShort
+		}
+
+		host = net.IP(b[4 : 4+net.IPv4len]).String()
+	case aTypDomain:
+		if len(b) < 5 {
+			return "", 0, nil, ErrUdpHeaderTooShort
+		}
+
+		hLen = 5 + int(b[4]) + 2
+		if len(b) < hLen {
+			return "", 0, nil, ErrUdpHeaderTooShort
+		}
+
+		host = string(b[5 : 5+int(b[4])])
+	case aTypIpv6:
+		hLen = 4 + net.IPv6len + 2
+		if len(b) < hLen {
+			return "", 0, nil, ErrUdpHeaderTooShort
+		}
+
+		host = net.IP(b[4 : 4+net.IPv6len]).String()
+	default:
+		return "", 0, nil, ErrUdpHeaderInvalidATyp
+	}
+
+	return host, int(b[hLen-2])<<8 | int(b[hLen-1]), b[hLen:], nil
+}
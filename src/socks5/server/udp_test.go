@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseUdpHeader(t *testing.T) {
+	var (
+		cases = []struct {
+			b    []byte
+			host string
+			port int
+			data string
+			err  error
+		}{
+			{[]byte{0, 0, 0, aTypIpv4, 10, 0, 0, 1, 0, 53, 'x'}, "10.0.0.1", 53, "x", nil},
+			{append([]byte{0, 0, 0, aTypDomain, 4, 'c', 'o', 'l', 'a', 1, 0}, "hi"...), "cola", 256, "hi", nil},
+			{append(append([]byte{0, 0, 0, aTypIpv6}, net.IPv6loopback...), 0, 80), "::1", 80, "", nil},
+			{[]byte{0, 0, 0}, "", 0, "", ErrUdpHeaderTooShort},
+			{[]byte{0, 1, 0, aTypIpv4, 10, 0, 0, 1, 0, 53}, "", 0, "", ErrUdpHeaderInvalidRsv},
+			{[]byte{0, 0, 1, aTypIpv4, 10, 0, 0, 1, 0, 53}, "", 0, "", ErrUdpHeaderFragmented},
+			{[]byte{0, 0, 0, 5, 10, 0, 0, 1, 0, 53}, "", 0, "", ErrUdpHeaderInvalidATyp},
+			{[]byte{0, 0, 0, aTypIpv4, 10, 0, 0}, "", 0, "", ErrUdpHeaderTooShort},
+			{[]byte{0, 0, 0, aTypDomain, 9, 'c'}, "", 0, "", ErrUdpHeaderTooShort},
+		}
+	)
+
+	for _, c := range cases {
+		host, port, data, err := parseUdpHeader(c.b)
+		if err != c.err || host != c.host || port != c.port || string(data) != c.data {
+			t.Fatal("Unexpected result of", c.b, host, port, data, err)
+		}
+	}
+}
+
+// listenUdpEcho echoes the datagrams sent to it
+func listenUdpEcho(t *testing.T) *net.UDPConn {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return pc
+}
+
+// associate starts an UDP association on the server at addr, the returned
+// socket sends datagrams to the relay
+func associate(t *testing.T, addr string) (net.Conn, *net.UDPConn) {
+	return associateFrom(t, addr, net.IPv4(127, 0, 0, 1))
+}
+
+// associateFrom is associate of the client at ip
+func associateFrom(t *testing.T, addr string, ip net.IP) (net.Conn, *net.UDPConn) {
+	var (
+		ctrl  net.Conn
+		relay *net.UDPConn
+		buf   = make([]byte, 10)
+		err   error
+	)
+
+	if ctrl, err = (&net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}).Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+
+	ctrl.Write([]byte{version5, 1, authMethodBare})
+	if _, err = io.ReadFull(ctrl, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	ctrl.Write([]byte{version5, cmdUdp, reqRsv, aTypIpv4, 0, 0, 0, 0, 0, 0})
+	if _, err = io.ReadFull(ctrl, buf); err != nil || buf[1] != repSucceeded {
+		t.Fatal("Unexpected replay", buf, err)
+	}
+
+	if relay, err = net.DialUDP("udp", &net.UDPAddr{IP: ip}, &net.UDPAddr{IP: net.IP(buf[4:8]), Port: int(buf[8])<<8 | int(buf[9])}); err != nil {
+		t.Fatal(err)
+	}
+
+	return ctrl, relay
+}
+
+// echoed reports whether the payload sent to dst through the relay comes back
+func echoed(relay *net.UDPConn, dst *net.UDPAddr) bool {
+	var (
+		buf = make([]byte, 512)
+		msg = []byte("ping " + dst.String())
+	)
+
+	relay.Write(append(appendAddr([]byte{reqRsv, reqRsv, 0}, dst.IP, dst.Port), msg...))
+
+	relay.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := relay.Read(buf)
+	return err == nil && n > 10 && bytes.Equal(buf[10:n], msg)
+}
+
+func TestUdpFilter(t *testing.T) {
+	var (
+		allowed = listenUdpEcho(t)
+		denied  = listenUdpEcho(t)
+		routed  = listenUdpEcho(t)
+		port    = func(pc *net.UDPConn) string { return strconv.Itoa(pc.LocalAddr().(*net.UDPAddr).Port) }
+		srv     = listenServer(t, &Config{
+			AclRules:   []*AclRule{{Action: aclActionDeny, Ports: []string{port(denied)}}},
+			RouteRules: []*RouteRule{{Action: routeActionReject, Ports: []string{port(routed)}}},
+		})
+	)
+
+	defer allowed.Close()
+	defer denied.Close()
+	defer routed.Close()
+	defer srv.Close()
+
+	ctrl, relay := associate(t, srv.Addr().String())
+	defer ctrl.Close()
+	defer relay.Close()
+
+	if !echoed(relay, allowed.LocalAddr().(*net.UDPAddr)) {
+		t.Fatal("Expected the datagram to be relayed")
+	}
+
+	if echoed(relay, denied.LocalAddr().(*net.UDPAddr)) {
+		t.Fatal("Expected the datagram to be denied by the ACL")
+	}
+
+	if echoed(relay, routed.LocalAddr().(*net.UDPAddr)) {
+		t.Fatal("Expected the datagram to be rejected by the route rules")
+	}
+}
+
+func TestUdpGuard(t *testing.T) {
+	var (
+		echo = listenUdpEcho(t)
+		l    net.Listener
+		err  error
+	)
+
+	defer echo.Close()
+
+	// the guard isn't relaxed for loopback as listenServer does
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	go (&Server{Cfg: &Config{}, StartTime: time.Now()}).Serve(l)
+
+	ctrl, relay := associate(t, l.Addr().String())
+	defer ctrl.Close()
+	defer relay.Close()
+
+	if echoed(relay, echo.LocalAddr().(*net.UDPAddr)) {
+		t.Fatal("Expected the datagram to be blocked by the guard")
+	}
+}
+
+func TestUdpAnonLimiter(t *testing.T) {
+	var (
+		echo = listenUdpEcho(t)
+		dst  = echo.LocalAddr().(*net.UDPAddr)
+		srv  = listenServer(t, &Config{RateLimit: &RateLimit{Up: 1000}})
+		buf  = make([]byte, 512)
+	)
+
+	defer echo.Close()
+	defer srv.Close()
+
+	ctrlA, relayA := associateFrom(t, srv.Addr().String(), net.IPv4(127, 0, 0, 1))
+	defer ctrlA.Close()
+	defer relayA.Close()
+
+	ctrlB, relayB := associateFrom(t, srv.Addr().String(), net.IPv4(127, 0, 0, 2))
+	defer ctrlB.Close()
+	defer relayB.Close()
+
+	// the bucket of A is used up for the next second
+	for i := 0; i < 2; i++ {
+		relayA.Write(append(appendAddr([]byte{reqRsv, reqRsv, 0}, dst.IP, dst.Port), make([]byte, 990)...))
+	}
+
+	relayA.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := relayA.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if !echoed(relayB, dst) {
+		t.Fatal("Expected the anonymous client at another IP to have its own limiter")
+	}
+}
+
+func TestUdpPeers(t *testing.T) {
+	var (
+		r    = &udpRelay{c: &conn{server: &Server{Cfg: &Config{}}}, peers: make(map[string]int64)}
+		idle = (&net.UDPAddr{IP: net.IPv4(10, 0, 0, 0), Port: 53}).String()
+	)
+
+	for i := 0; i < udpMaxPeers+10; i++ {
+		r.addPeer(&net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 53})
+	}
+
+	if len(r.peers) != udpMaxPeers {
+		t.Fatal("Expected the peers to be capped", len(r.peers))
+	}
+
+	r.peers[idle] = 0
+	r.addPeer(&net.UDPAddr{IP: net.IPv4(10, 1, 0, 0), Port: 53})
+	if _, ok := r.peers[idle]; ok || len(r.peers) != udpMaxPeers {
+		t.Fatal("Expected the idle peer to be forgotten")
+	}
+}
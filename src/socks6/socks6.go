@@ -0,0 +1,552 @@
+// Package socks6 implements the wire format of the SOCKS6 protocol described by
+// https://tools.ietf.org/html/draft-olteanu-intarea-socks-6-11
+//
+// every variable length field is padded with zeros to a multiple of 4 bytes,
+// which includes the domain name address and the data of options.
+package socks6
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	Version = byte(6)
+
+	CmdNoop         = byte(0)
+	CmdConnect      = byte(1)
+	CmdBind         = byte(2)
+	CmdUdpAssociate = byte(3)
+
+	ATypIpv4   = byte(1)
+	ATypDomain = byte(3)
+	ATypIpv6   = byte(4)
+
+	AuthSucceeded = byte(0)
+	AuthFailed    = byte(1)
+
+	RepSucceeded            = byte(0)
+	RepGeneralServerFailure = byte(1)
+	RepNotAllowed           = byte(2)
+	RepNetUnReachable       = byte(3)
+	RepHostUnReachable      = byte(4)
+	RepConnRefused          = byte(5)
+	RepTtlExpired           = byte(6)
+	RepCmdNotSupported      = byte(7)
+	RepATypNotSupported     = byte(8)
+	RepTimeout              = byte(9)
+
+	OptStack                  = uint16(1)
+	OptAuthMethodAdvert       = uint16(2)
+	OptAuthMethodSelect       = uint16(3)
+	OptAuthData               = uint16(4)
+	OptSessionRequest         = uint16(5)
+	OptSessionId              = uint16(6)
+	OptSessionOk              = uint16(8)
+	OptSessionInvalid         = uint16(9)
+	OptSessionTeardown        = uint16(10)
+	OptTokenRequest           = uint16(11)
+	OptIdempotenceWindow      = uint16(12)
+	OptIdempotenceExpenditure = uint16(13)
+	OptIdempotenceAccepted    = uint16(14)
+	OptIdempotenceRejected    = uint16(15)
+
+	StackLegClientProxy = byte(1)
+	StackLegProxyRemote = byte(2)
+	StackLegBoth        = byte(3)
+
+	StackLevelTcp = byte(4)
+
+	StackCodeTfo = byte(1)
+
+	MethodNone  = byte(0)
+	MethodUnPwd = byte(2)
+
+	UnPwdVersion = byte(1)
+
+	optHeaderLen = 4
+	maxOptsLen   = 1<<16 - 1
+)
+
+var (
+	ErrReadBytes          = errors.New("Socks6: failed to read bytes.")
+	ErrUnsupportedVersion = errors.New("Socks6: unsupported version.")
+	ErrInvalidATyp        = errors.New("Socks6: invalid address type.")
+	ErrInvalidDomain      = errors.New("Socks6: invalid domain name.")
+	ErrInvalidOption      = errors.New("Socks6: invalid option.")
+	ErrOptionsTooLong     = errors.New("Socks6: options are too long.")
+	ErrInvalidAuthData    = errors.New("Socks6: invalid authentication data.")
+)
+
+// Option is a TLV option, Data includes the padding
+type Option struct {
+	Kind uint16
+	Data []byte
+}
+
+type Options []Option
+
+// Get returns the first option of the kind
+func (os Options) Get(kind uint16) (Option, bool) {
+	for _, o := range os {
+		if o.Kind == kind {
+			return o, true
+		}
+	}
+
+	return Option{}, false
+}
+
+// Has reports whether there is an option of the kind
+func (os Options) Has(kind uint16) bool {
+	_, ok := os.Get(kind)
+	return ok
+}
+
+func (os Options) bytes() []byte {
+	var (
+		b []byte
+	)
+
+	for _, o := range os {
+		l := optHeaderLen + padLen(len(o.Data))
+		b = append(b, byte(o.Kind>>8), byte(o.Kind), byte(l>>8), byte(l))
+		b = append(b, o.Data...)
+		b = append(b, make([]byte, l-optHeaderLen-len(o.Data))...)
+	}
+
+	return b
+}
+
+func readOptions(r io.Reader, n int) (Options, error) {
+	var (
+		buf  = make([]byte, n)
+		os   Options
+		kind uint16
+		l    int
+	)
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, ErrReadBytes
+	}
+
+	for len(buf) > 0 {
+		if len(buf) < optHeaderLen {
+			return nil, ErrInvalidOption
+		}
+
+		kind = binary.BigEndian.Uint16(buf)
+		l = int(binary.BigEndian.Uint16(buf[2:]))
+		if l < optHeaderLen || l > len(buf) {
+			return nil, ErrInvalidOption
+		}
+
+		os = append(os, Option{kind, buf[optHeaderLen:l]})
+		buf = buf[l:]
+	}
+
+	return os, nil
+}
+
+// Addr is the address and port carried by requests and replies
+type Addr struct {
+	ATyp   byte
+	IP     net.IP
+	Domain string
+	Port   uint16
+}
+
+// NewAddr parses "host:port", the host is kept as a domain name unless it's an IP
+func NewAddr(hostport string) (*Addr, error) {
+	var (
+		host string
+		port string
+		p    int
+		err  error
+		a    = &Addr{}
+	)
+
+	if host, port, err = net.SplitHostPort(hostport); err != nil {
+		return nil, err
+	}
+
+	if p, err = strconv.Atoi(port); err != nil || p < 0 || p > 0xFFFF {
+		return nil, &net.AddrError{Err: "invalid port", Addr: hostport}
+	}
+
+	a.Port = uint16(p)
+	if a.IP = net.ParseIP(host); a.IP == nil {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, ErrInvalidDomain
+		}
+
+		a.ATyp = ATypDomain
+		a.Domain = host
+	} else if a.IP.To4() != nil {
+		a.ATyp = ATypIpv4
+	} else {
+		a.ATyp = ATypIpv6
+	}
+
+	return a, nil
+}
+
+// FromTCPAddr converts a TCP address, a nil addr becomes 0.0.0.0:0
+func FromTCPAddr(addr *net.TCPAddr) *Addr {
+	if addr == nil {
+		return &Addr{ATyp: ATypIpv4, IP: net.IPv4zero}
+	}
+
+	if addr.IP.To4() != nil {
+		return &Addr{ATyp: ATypIpv4, IP: addr.IP, Port: uint16(addr.Port)}
+	}
+
+	return &Addr{ATyp: ATypIpv6, IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (a *Addr) Host() string {
+	if a.ATyp == ATypDomain {
+		return a.Domain
+	}
+
+	return a.IP.String()
+}
+
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Host(), strconv.Itoa(int(a.Port)))
+}
+
+// bytes returns PORT, PADDING, ATYP and ADDRESS
+func (a *Addr) bytes() []byte {
+	var (
+		b = []byte{byte(a.Port >> 8), byte(a.Port), 0, a.ATyp}
+	)
+
+	switch a.ATyp {
+	case ATypIpv4:
+		b = append(b, a.IP.To4()...)
+	case ATypIpv6:
+		b = append(b, a.IP.To16()...)
+	case ATypDomain:
+		b = append(b, byte(len(a.Domain)))
+		b = append(b, a.Domain...)
+		b = append(b, make([]byte, padLen(1+len(a.Domain))-1-len(a.Domain))...)
+	}
+
+	return b
+}
+
+func readAddr(r io.Reader) (*Addr, error) {
+	var (
+		buf = make([]byte, 4)
+		a   = &Addr{}
+		err error
+	)
+
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, ErrReadBytes
+	}
+
+	a.Port = binary.BigEndian.Uint16(buf)
+	a.ATyp = buf[3]
+
+	switch a.ATyp {
+	case ATypIpv4:
+		a.IP = make(net.IP, net.IPv4len)
+		_, err = io.ReadFull(r, a.IP)
+	case ATypIpv6:
+		a.IP = make(net.IP, net.IPv6len)
+		_, err = io.ReadFull(r, a.IP)
+	case ATypDomain:
+		if _, err = io.ReadFull(r, buf[:1]); err != nil {
+			return nil, ErrReadBytes
+		}
+
+		if buf[0] == 0 {
+			return nil, ErrInvalidDomain
+		}
+
+		name := make([]byte, padLen(1+int(buf[0]))-1)
+		_, err = io.ReadFull(r, name)
+		a.Domain = string(name[:buf[0]])
+	default:
+		return nil, ErrInvalidATyp
+	}
+
+	if err != nil {
+		return nil, ErrReadBytes
+	}
+
+	return a, nil
+}
+
+// Request is sent by the client to start an operation
+type Request struct {
+	Cmd     byte
+	Addr    *Addr
+	Options Options
+}
+
+func (req *Request) Bytes() ([]byte, error) {
+	var (
+		opts = req.Options.bytes()
+		b    []byte
+	)
+
+	if len(opts) > maxOptsLen {
+		return nil, ErrOptionsTooLong
+	}
+
+	b = []byte{Version, req.Cmd, byte(len(opts) >> 8), byte(len(opts))}
+	b = append(b, req.Addr.bytes()...)
+	return append(b, opts...), nil
+}
+
+func ReadRequest(r io.Reader) (*Request, error) {
+	var (
+		buf = make([]byte, 4)
+		req = &Request{}
+		err error
+	)
+
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, ErrReadBytes
+	}
+
+	if buf[0] != Version {
+		return nil, ErrUnsupportedVersion
+	}
+
+	req.Cmd = buf[1]
+	if req.Addr, err = readAddr(r); err != nil {
+		return nil, err
+	}
+
+	if req.Options, err = readOptions(r, int(binary.BigEndian.Uint16(buf[2:]))); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// AuthReply is sent by the proxy after authenticating the request
+type AuthReply struct {
+	Type    byte
+	Options Options
+}
+
+func (rep *AuthReply) Bytes() ([]byte, error) {
+	var (
+		opts = rep.Options.bytes()
+	)
+
+	if len(opts) > maxOptsLen {
+		return nil, ErrOptionsTooLong
+	}
+
+	return append([]byte{Version, rep.Type, byte(len(opts) >> 8), byte(len(opts))}, opts...), nil
+}
+
+func ReadAuthReply(r io.Reader) (*AuthReply, error) {
+	var (
+		buf = make([]byte, 4)
+		rep = &AuthReply{}
+		err error
+	)
+
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, ErrReadBytes
+	}
+
+	if buf[0] != Version {
+		return nil, ErrUnsupportedVersion
+	}
+
+	rep.Type = buf[1]
+	if rep.Options, err = readOptions(r, int(binary.BigEndian.Uint16(buf[2:]))); err != nil {
+		return nil, err
+	}
+
+	return rep, nil
+}
+
+// OpReply is sent by the proxy once the operation is done or failed
+type OpReply struct {
+	Code    byte
+	Addr    *Addr
+	Options Options
+}
+
+func (rep *OpReply) Bytes() ([]byte, error) {
+	var (
+		opts = rep.Options.bytes()
+		addr = rep.Addr
+		b    []byte
+	)
+
+	if len(opts) > maxOptsLen {
+		return nil, ErrOptionsTooLong
+	}
+
+	if addr == nil {
+		addr = FromTCPAddr(nil)
+	}
+
+	b = []byte{Version, rep.Code, byte(len(opts) >> 8), byte(len(opts))}
+	b = append(b, addr.bytes()...)
+	return append(b, opts...), nil
+}
+
+func ReadOpReply(r io.Reader) (*OpReply, error) {
+	var (
+		buf = make([]byte, 4)
+		rep = &OpReply{}
+		err error
+	)
+
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, ErrReadBytes
+	}
+
+	if buf[0] != Version {
+		return nil, ErrUnsupportedVersion
+	}
+
+	rep.Code = buf[1]
+	if rep.Addr, err = readAddr(r); err != nil {
+		return nil, err
+	}
+
+	if rep.Options, err = readOptions(r, int(binary.BigEndian.Uint16(buf[2:]))); err != nil {
+		return nil, err
+	}
+
+	return rep, nil
+}
+
+// StackOption creates a stack option, leg is one of StackLeg*
+func StackOption(leg byte, level byte, code byte, data []byte) Option {
+	return Option{OptStack, append([]byte{leg<<6 | level&0x3F, code}, data...)}
+}
+
+// ParseStackOption returns the leg, level, code and data of a stack option
+func ParseStackOption(o Option) (leg byte, level byte, code byte, data []byte, err error) {
+	if o.Kind != OptStack || len(o.Data) < 2 {
+		return 0, 0, 0, nil, ErrInvalidOption
+	}
+
+	return o.Data[0] >> 6, o.Data[0] & 0x3F, o.Data[1], o.Data[2:], nil
+}
+
+// TfoOption asks the proxy to use TCP Fast Open towards the remote host with
+// a payload of at most payloadSize bytes in the SYN
+func TfoOption(payloadSize uint16) Option {
+	return StackOption(StackLegProxyRemote, StackLevelTcp, StackCodeTfo, []byte{byte(payloadSize >> 8), byte(payloadSize)})
+}
+
+// IsTfoOption reports whether o asks for TCP Fast Open on the proxy-remote leg
+func IsTfoOption(o Option) bool {
+	leg, level, code, _, err := ParseStackOption(o)
+	return err == nil && leg&StackLegProxyRemote != 0 && level == StackLevelTcp && code == StackCodeTfo
+}
+
+// AuthMethodAdvertOption advertises the auth methods and the length of the data
+// sent right after the request, method 0 is always implied
+func AuthMethodAdvertOption(initialDataLen uint16, methods ...byte) Option {
+	return Option{OptAuthMethodAdvert, append([]byte{byte(initialDataLen >> 8), byte(initialDataLen)}, methods...)}
+}
+
+// ParseAuthMethodAdvertOption returns the initial data length and the methods,
+// the padding is returned as method 0 which is harmless since it's implied
+func ParseAuthMethodAdvertOption(o Option) (uint16, []byte, error) {
+	if o.Kind != OptAuthMethodAdvert || len(o.Data) < 2 {
+		return 0, nil, ErrInvalidOption
+	}
+
+	return binary.BigEndian.Uint16(o.Data), o.Data[2:], nil
+}
+
+func AuthMethodSelectOption(method byte) Option {
+	return Option{OptAuthMethodSelect, []byte{method}}
+}
+
+// AuthDataOption carries the data of the method, the data of method 2 is
+// the RFC 1929 request
+func AuthDataOption(method byte, data []byte) Option {
+	return Option{OptAuthData, append([]byte{method}, data...)}
+}
+
+func UnPwdAuthData(un []byte, pwd []byte) []byte {
+	var (
+		b = []byte{UnPwdVersion, byte(len(un))}
+	)
+
+	b = append(b, un...)
+	b = append(b, byte(len(pwd)))
+	return append(b, pwd...)
+}
+
+func ParseUnPwdAuthData(o Option) (un []byte, pwd []byte, err error) {
+	var (
+		d = o.Data
+	)
+
+	if o.Kind != OptAuthData || len(d) < 3 || d[0] != MethodUnPwd || d[1] != UnPwdVersion {
+		return nil, nil, ErrInvalidAuthData
+	}
+
+	d = d[2:]
+	if len(d) < 1+int(d[0])+1 {
+		return nil, nil, ErrInvalidAuthData
+	}
+
+	un, d = d[1:1+int(d[0])], d[1+int(d[0]):]
+	if len(d) < 1+int(d[0]) {
+		return nil, nil, ErrInvalidAuthData
+	}
+
+	pwd = d[1 : 1+int(d[0])]
+	return un, pwd, nil
+}
+
+func SessionIdOption(id []byte) Option {
+	return Option{OptSessionId, id}
+}
+
+func TokenRequestOption(windowSize uint32) Option {
+	return Option{OptTokenRequest, uint32Bytes(windowSize)}
+}
+
+func IdempotenceWindowOption(base uint32, size uint32) Option {
+	return Option{OptIdempotenceWindow, append(uint32Bytes(base), uint32Bytes(size)...)}
+}
+
+func IdempotenceExpenditureOption(token uint32) Option {
+	return Option{OptIdempotenceExpenditure, uint32Bytes(token)}
+}
+
+// Uint32 returns the i-th 4 bytes of the data as an uint32, it's used by
+// the token related options
+func (o Option) Uint32(i int) (uint32, error) {
+	if len(o.Data) < 4*(i+1) {
+		return 0, ErrInvalidOption
+	}
+
+	return binary.BigEndian.Uint32(o.Data[4*i:]), nil
+}
+
+func uint32Bytes(v uint32) []byte {
+	var (
+		b = make([]byte, 4)
+	)
+
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func padLen(n int) int {
+	return (n + 3) &^ 3
+}